@@ -0,0 +1,183 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hipages/php-fpm_exporter/phpfpm"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// loadConfig returns the pools of the configuration file and --phpfpm.scrape-uri.
+// The default scrape URI is only used if no other source of pools is configured.
+func loadConfig(cmd *cobra.Command) (phpfpm.Config, error) {
+	cfg := phpfpm.Config{}
+
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return cfg, fmt.Errorf("invalid config file %v: %w", viper.ConfigFileUsed(), err)
+	}
+
+	if cmd.Flags().Changed("phpfpm.scrape-uri") || (len(cfg.Pools)+len(cfg.Groups) == 0 && fpmConfigFile == "" && len(fileSDFiles) == 0 && !discoverProc) {
+		for _, uri := range scrapeURIs {
+			cfg.Pools = append(cfg.Pools, phpfpm.PoolConfig{Address: uri})
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid pool configuration: %v", strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+
+	return cfg, nil
+}
+
+// newPoolManager creates a PoolManager for all configured pools.
+func newPoolManager(cmd *cobra.Command, keepAlive bool) (*phpfpm.PoolManager, error) {
+	pm := &phpfpm.PoolManager{KeepAlive: keepAlive}
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return pm, err
+	}
+
+	for _, pc := range cfg.PoolConfigs() {
+		if _, err := pm.AddConfig(pc); err != nil {
+			return pm, err
+		}
+	}
+
+	if discoverProc {
+		pm.ProcDiscovery = &phpfpm.ProcDiscovery{ProcRoot: procRoot, StatusPath: procStatusPath}
+	}
+
+	for _, path := range fileSDFiles {
+		if err := addFileSDPools(pm, path); err != nil {
+			return pm, err
+		}
+	}
+
+	if fpmConfigFile == "" {
+		return pm, nil
+	}
+
+	return pm, discoverFPMPools(pm, fpmConfigFile)
+}
+
+// addFileSDPools adds the targets of a Prometheus file_sd file.
+// Pools already configured with the same scrape URI are left alone.
+func addFileSDPools(pm *phpfpm.PoolManager, path string) error {
+	pools, err := phpfpm.ReadFileSD(path)
+	if err != nil {
+		return err
+	}
+
+	configured := map[string]bool{}
+	for _, p := range pm.Pools {
+		configured[p.Address] = true
+	}
+	for _, g := range pm.Globs {
+		configured[g.Template.Address] = true
+	}
+
+	for _, pc := range pools {
+		if configured[pc.Address] {
+			log.Debugf("Target %v from %v is already configured", phpfpm.RedactAddress(pc.Address), path)
+			continue
+		}
+
+		if _, err := pm.AddConfig(pc); err != nil {
+			return fmt.Errorf("target %v from %v: %w", phpfpm.RedactAddress(pc.Address), path, err)
+		}
+		configured[pc.Address] = true
+	}
+
+	return nil
+}
+
+// discoverFPMPools adds the pools of php-fpm.conf which expose a status page.
+// Pools already configured with the same scrape URI are left alone.
+func discoverFPMPools(pm *phpfpm.PoolManager, path string) error {
+	fpmPools, err := phpfpm.ParseFPMConfig(path, fpmPrefix)
+	if err != nil {
+		return fmt.Errorf("unable to read php-fpm config: %w", err)
+	}
+
+	configured := map[string]bool{}
+	for _, p := range pm.Pools {
+		configured[p.Address] = true
+	}
+
+	for _, c := range fpmPools {
+		uri, err := c.ScrapeURI()
+		if err != nil {
+			log.Infof("Skipping pool from %v: %v", path, err)
+			continue
+		}
+
+		if configured[uri] {
+			log.Debugf("Pool %v from %v is already configured", c.Name, path)
+			continue
+		}
+
+		if _, err := pm.AddFPMConfig(c); err != nil {
+			return fmt.Errorf("pool %v from %v: %w", c.Name, path, err)
+		}
+		configured[uri] = true
+
+		log.Debugf("Discovered pool %v at %v", c.Name, uri)
+	}
+
+	return nil
+}
+
+// Flags of the /proc discovery shared by the get and server commands.
+var (
+	discoverProc   bool
+	procRoot       string
+	procStatusPath string
+)
+
+// addProcDiscoveryFlags adds the flags of the /proc discovery to cmd.
+func addProcDiscoveryFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&discoverProc, "phpfpm.discover-proc", false, "Enable to discover PHP-FPM master processes and their sockets in /proc. Requires access to the PID namespace of PHP-FPM.")
+	cmd.Flags().StringVar(&procRoot, "phpfpm.proc-root", "/proc", "Mount point of procfs used by --phpfpm.discover-proc.")
+	cmd.Flags().StringVar(&procStatusPath, "phpfpm.proc-status-path", "/status", "pm.status_path of the pools discovered by --phpfpm.discover-proc.")
+}
+
+// reloadMutex serializes reloads triggered via SIGHUP and HTTP.
+var reloadMutex sync.Mutex
+
+// reloadConfig re-reads the config file and syncs the pools of the exporter. Unchanged pools keep their state.
+// The previous pools stay in place if the new configuration is invalid.
+func reloadConfig(cmd *cobra.Command, exporter *phpfpm.Exporter, keepAlive bool) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if err := readConfig(); err != nil {
+		return err
+	}
+
+	pm, err := newPoolManager(cmd, keepAlive)
+	if err != nil {
+		return err
+	}
+
+	exporter.Sync(pm)
+	log.Info("Configuration reloaded")
+
+	return nil
+}
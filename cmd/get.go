@@ -39,10 +39,9 @@ var getCmd = &cobra.Command{
 * php-fpm_exporter get --phpfpm.scrape-uri 127.0.0.1:9000,127.0.0.1:9001,[...]
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		pm := phpfpm.PoolManager{}
-
-		for _, uri := range scrapeURIs {
-			pm.Add(uri)
+		pm, err := newPoolManager(cmd, false)
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		if err := pm.Update(); err != nil {
@@ -64,7 +63,7 @@ var getCmd = &cobra.Command{
 			pools := pm.Pools
 
 			for _, pool := range pools {
-				table.AddRow("Address:", pool.Address)
+				table.AddRow("Address:", phpfpm.RedactAddress(pool.Address))
 				table.AddRow("Pool:", pool.Name)
 				table.AddRow("Start time:", time.Time(pool.StartTime).Format(time.RFC1123Z))
 				table.AddRow("Start since:", pool.StartSince)
@@ -78,6 +77,9 @@ var getCmd = &cobra.Command{
 				table.AddRow("Max active processes:", pool.MaxActiveProcesses)
 				table.AddRow("Max children reached:", pool.MaxChildrenReached)
 				table.AddRow("Slow requests:", pool.SlowRequests)
+				if pool.LastStderr != "" {
+					table.AddRow("Last stderr:", pool.LastStderr)
+				}
 				table.AddRow("")
 			}
 
@@ -101,6 +103,10 @@ func init() {
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	getCmd.Flags().StringSliceVar(&scrapeURIs, "phpfpm.scrape-uri", []string{"tcp://127.0.0.1:9000/status"}, "FastCGI address, e.g. unix:///tmp/php.sock;/status or tcp://127.0.0.1:9000/status")
+	getCmd.Flags().StringSliceVar(&scrapeURIs, "phpfpm.scrape-uri", []string{"tcp://127.0.0.1:9000/status"}, "FastCGI or HTTP address, e.g. unix:///tmp/php.sock;/status, tcp://127.0.0.1:9000/status?timeout=5s or https://example.com/fpm-status")
+	getCmd.Flags().StringVar(&fpmConfigFile, "phpfpm.fpm-config", "", "Path to php-fpm.conf to discover pools with a pm.status_path from, e.g. /etc/php/8.2/fpm/php-fpm.conf")
+	getCmd.Flags().StringVar(&fpmPrefix, "phpfpm.fpm-prefix", phpfpm.DefaultFPMPrefix, "Prefix PHP-FPM runs with (-p) that relative includes of --phpfpm.fpm-config are resolved against.")
+	getCmd.Flags().StringSliceVar(&fileSDFiles, "phpfpm.file-sd", nil, "Prometheus file_sd file (JSON or YAML) to read scrape URIs and labels from.")
+	addProcDiscoveryFlags(getCmd)
 	getCmd.Flags().StringVar(&output, "out", "text", "Output format. One of: text, json, spew")
 }
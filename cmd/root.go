@@ -79,11 +79,26 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
+	if err := readConfig(); err != nil {
+		fmt.Println("Could not read config file:", err)
+		os.Exit(1)
+	}
+
+	if viper.ConfigFileUsed() != "" {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
 }
 
+// readConfig (re-)reads the config file. A missing config file is only an error if it was requested explicitly.
+func readConfig() error {
+	err := viper.ReadInConfig()
+	if _, notFound := err.(viper.ConfigFileNotFoundError); notFound && cfgFile == "" {
+		return nil
+	}
+
+	return err
+}
+
 // initLogger configures the log level
 func initLogger() {
 	phpfpm.SetLogger(log)
@@ -106,7 +121,7 @@ func mapEnvVars(envs map[string]string, cmd *cobra.Command) {
 		flag := cmd.Flags().Lookup(flag)
 		flag.Usage = fmt.Sprintf("%v [env %v]", flag.Usage, env)
 		if value := os.Getenv(env); value != "" {
-			if err := flag.Value.Set(value); err != nil {
+			if err := cmd.Flags().Set(flag.Name, value); err != nil {
 				log.Error(err)
 			}
 		}
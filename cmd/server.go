@@ -15,6 +15,7 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -31,8 +32,20 @@ import (
 var (
 	listeningAddress string
 	metricsEndpoint  string
+	probeAllow       []string
+	adminToken       string
+	enableLifecycle  bool
 	scrapeURIs       []string
+	fpmConfigFile    string
+	fpmPrefix        string
+	fileSDFiles      []string
 	fixProcessCount  bool
+	keepAlive        bool
+	refreshInterval  time.Duration
+	maxSnapshotAge   time.Duration
+	rescanInterval   time.Duration
+	maxConcurrency   int
+	timeoutOffset    time.Duration
 )
 
 // serverCmd represents the server command
@@ -48,12 +61,13 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Infof("Starting server on %v with path %v", listeningAddress, metricsEndpoint)
 
-		pm := phpfpm.PoolManager{}
-
-		for _, uri := range scrapeURIs {
-			pm.Add(uri)
+		pm, err := newPoolManager(cmd, keepAlive)
+		if err != nil {
+			log.Fatal(err)
 		}
 
+		pm.RescanInterval = rescanInterval
+		pm.MaxConcurrency = maxConcurrency
 		exporter := phpfpm.NewExporter(pm)
 
 		if fixProcessCount {
@@ -61,7 +75,15 @@ to quickly create a Cobra application.`,
 			exporter.CountProcessState = true
 		}
 
-		prometheus.MustRegister(exporter)
+		exporter.MaxSnapshotAge = maxSnapshotAge
+
+		backgroundCtx, stopBackground := context.WithCancel(context.Background())
+		defer stopBackground()
+
+		if refreshInterval > 0 {
+			log.Infof("Refreshing pools every %v in the background.", refreshInterval)
+			go exporter.Run(backgroundCtx, refreshInterval)
+		}
 
 		srv := &http.Server{
 			Addr: listeningAddress,
@@ -71,7 +93,51 @@ to quickly create a Cobra application.`,
 			IdleTimeout:  time.Second * 60,
 		}
 
-		http.Handle(metricsEndpoint, promhttp.Handler())
+		// The exporter is registered per request so PHP-FPM scrapes are cancelled when Prometheus gives up.
+		metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := phpfpm.ScrapeContext(r, timeoutOffset)
+			defer cancel()
+
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(exporter.WithContext(ctx))
+
+			gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+			promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+		}
+
+		http.Handle(metricsEndpoint, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(metricsHandler)))
+
+		prober, err := phpfpm.NewProber(probeAllow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prober.CountProcessState = fixProcessCount
+		prober.TimeoutOffset = timeoutOffset
+		http.Handle("/probe", prober)
+
+		if adminToken != "" {
+			log.Info("Pool management API enabled on /api/v1/pools")
+			http.Handle("/api/v1/pools", phpfpm.NewPoolAPI(exporter, adminToken))
+		}
+
+		// A reload replaces the pools added via the API, so it requires the same token if there is one.
+		var reload http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			if err := reloadConfig(cmd, exporter, keepAlive); err != nil {
+				log.Errorf("Failed to reload config: %v", err)
+				http.Error(w, fmt.Sprintf("Failed to reload config: %v", err), http.StatusInternalServerError)
+			}
+		})
+		if adminToken != "" {
+			http.Handle("/-/reload", phpfpm.RequireBearerToken(adminToken, reload))
+		} else if enableLifecycle {
+			http.Handle("/-/reload", reload)
+		}
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			_, err := w.Write([]byte(`<html>
 			 <head><title>php-fpm_exporter</title></head>
@@ -93,6 +159,31 @@ to quickly create a Cobra application.`,
 			}
 		}()
 
+		// Reload the configuration whenever a file_sd file changes.
+		if len(fileSDFiles) > 0 {
+			go func() {
+				err := phpfpm.WatchFileSD(backgroundCtx, fileSDFiles, func() {
+					if err := reloadConfig(cmd, exporter, keepAlive); err != nil {
+						log.Errorf("Failed to reload config after file_sd change: %v", err)
+					}
+				})
+				if err != nil {
+					log.Error(err)
+				}
+			}()
+		}
+
+		// Reload the configuration on SIGHUP.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloadConfig(cmd, exporter, keepAlive); err != nil {
+					log.Errorf("Failed to reload config: %v", err)
+				}
+			}
+		}()
+
 		c := make(chan os.Signal, 1)
 		// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C) or SIGTERM
 		// SIGKILL, SIGQUIT will not be caught.
@@ -110,6 +201,8 @@ to quickly create a Cobra application.`,
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Fatal("Error during shutdown", err)
 		}
+		stopBackground()
+		exporter.Close()
 		// Optionally, you could run srv.Shutdown in a goroutine and block on
 		// <-ctx.Done() if your application should wait for other services
 		// to finalize based on context cancellation.
@@ -123,16 +216,44 @@ func init() {
 
 	serverCmd.Flags().StringVar(&listeningAddress, "web.listen-address", ":9253", "Address on which to expose metrics and web interface.")
 	serverCmd.Flags().StringVar(&metricsEndpoint, "web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-	serverCmd.Flags().StringSliceVar(&scrapeURIs, "phpfpm.scrape-uri", []string{"tcp://127.0.0.1:9000/status"}, "FastCGI address, e.g. unix:///tmp/php.sock;/status or tcp://127.0.0.1:9000/status")
+	serverCmd.Flags().StringArrayVar(&probeAllow, "web.probe-allow", nil, "Regular expression a target of /probe has to match completely, e.g. 'tcp://10\\.0\\.0\\.\\d+:9000/status'. Can be repeated. Without it /probe rejects all targets.")
+	serverCmd.Flags().DurationVar(&timeoutOffset, "web.timeout-offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout Prometheus sends in X-Prometheus-Scrape-Timeout-Seconds, leaving time to send the metrics.")
+	serverCmd.Flags().StringVar(&adminToken, "web.admin-token", "", "Bearer token required by the pool management API on /api/v1/pools. The API is disabled without it. Prefer setting it via the environment.")
+	serverCmd.Flags().BoolVar(&enableLifecycle, "web.enable-lifecycle", false, "Enable reloading the configuration via POST to /-/reload without --web.admin-token. With --web.admin-token /-/reload is enabled and requires the token.")
+	serverCmd.Flags().StringSliceVar(&scrapeURIs, "phpfpm.scrape-uri", []string{"tcp://127.0.0.1:9000/status"}, "FastCGI or HTTP address, e.g. unix:///tmp/php.sock;/status, tcp://127.0.0.1:9000/status?timeout=5s or https://example.com/fpm-status")
+	serverCmd.Flags().StringVar(&fpmConfigFile, "phpfpm.fpm-config", "", "Path to php-fpm.conf to discover pools with a pm.status_path from, e.g. /etc/php/8.2/fpm/php-fpm.conf")
+	serverCmd.Flags().StringVar(&fpmPrefix, "phpfpm.fpm-prefix", phpfpm.DefaultFPMPrefix, "Prefix PHP-FPM runs with (-p) that relative includes of --phpfpm.fpm-config are resolved against.")
+	serverCmd.Flags().StringSliceVar(&fileSDFiles, "phpfpm.file-sd", nil, "Prometheus file_sd file (JSON or YAML) to read scrape URIs and labels from. Changes are picked up automatically.")
+	addProcDiscoveryFlags(serverCmd)
 	serverCmd.Flags().BoolVar(&fixProcessCount, "phpfpm.fix-process-count", false, "Enable to calculate process numbers via php-fpm_exporter since PHP-FPM sporadically reports wrong active/idle/total process numbers.")
+	serverCmd.Flags().DurationVar(&refreshInterval, "phpfpm.refresh-interval", 0, "Scrape PHP-FPM in the background at this interval and serve the latest snapshot, e.g. 5s. By default PHP-FPM is scraped on every request.")
+	serverCmd.Flags().DurationVar(&maxSnapshotAge, "phpfpm.max-snapshot-age", 0, "Report pools as down if their last background scrape is older than this, e.g. 30s. Disabled by default.")
+	serverCmd.Flags().DurationVar(&rescanInterval, "phpfpm.rescan-interval", 0, "Minimum time between rescans of scrape URIs with a glob pattern like unix:///run/php/*.sock;/status, e.g. 1m. By default sockets and /proc are rescanned on every scrape.")
+	serverCmd.Flags().IntVar(&maxConcurrency, "phpfpm.max-concurrency", 0, "Maximum number of pools scraped at the same time. By default all pools are scraped at once.")
+	serverCmd.Flags().BoolVar(&keepAlive, "phpfpm.keep-alive", false, "Enable to keep FastCGI connections to PHP-FPM open between scrapes instead of reconnecting every time.")
 
 	// Workaround since vipers BindEnv is currently not working as expected (see https://github.com/spf13/viper/issues/461)
 
 	envs := map[string]string{
-		"PHP_FPM_WEB_LISTEN_ADDRESS": "web.listen-address",
-		"PHP_FPM_WEB_TELEMETRY_PATH": "web.telemetry-path",
-		"PHP_FPM_SCRAPE_URI":         "phpfpm.scrape-uri",
-		"PHP_FPM_FIX_PROCESS_COUNT":  "phpfpm.fix-process-count",
+		"PHP_FPM_WEB_LISTEN_ADDRESS":   "web.listen-address",
+		"PHP_FPM_WEB_TELEMETRY_PATH":   "web.telemetry-path",
+		"PHP_FPM_WEB_PROBE_ALLOW":      "web.probe-allow",
+		"PHP_FPM_WEB_ADMIN_TOKEN":      "web.admin-token",
+		"PHP_FPM_WEB_ENABLE_LIFECYCLE": "web.enable-lifecycle",
+		"PHP_FPM_WEB_TIMEOUT_OFFSET":   "web.timeout-offset",
+		"PHP_FPM_SCRAPE_URI":           "phpfpm.scrape-uri",
+		"PHP_FPM_FPM_CONFIG":           "phpfpm.fpm-config",
+		"PHP_FPM_FPM_PREFIX":           "phpfpm.fpm-prefix",
+		"PHP_FPM_FILE_SD":              "phpfpm.file-sd",
+		"PHP_FPM_DISCOVER_PROC":        "phpfpm.discover-proc",
+		"PHP_FPM_PROC_ROOT":            "phpfpm.proc-root",
+		"PHP_FPM_PROC_STATUS_PATH":     "phpfpm.proc-status-path",
+		"PHP_FPM_FIX_PROCESS_COUNT":    "phpfpm.fix-process-count",
+		"PHP_FPM_KEEP_ALIVE":           "phpfpm.keep-alive",
+		"PHP_FPM_REFRESH_INTERVAL":     "phpfpm.refresh-interval",
+		"PHP_FPM_MAX_SNAPSHOT_AGE":     "phpfpm.max-snapshot-age",
+		"PHP_FPM_RESCAN_INTERVAL":      "phpfpm.rescan-interval",
+		"PHP_FPM_MAX_CONCURRENCY":      "phpfpm.max-concurrency",
 	}
 
 	mapEnvVars(envs, serverCmd)
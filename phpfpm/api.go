@@ -0,0 +1,217 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PoolAPI is an HTTP API to manage the pools of an Exporter at runtime:
+//
+//	GET    /api/v1/pools                   lists all pools
+//	POST   /api/v1/pools                   adds a pool, e.g. {"address": "tcp://10.0.0.5:9000/status", "labels": {"env": "prod"}}
+//	DELETE /api/v1/pools?address=<address> removes a pool
+//
+// Requests have to send the token as bearer token. Without a token every request is rejected.
+type PoolAPI struct {
+	exporter *Exporter
+	token    string
+}
+
+// NewPoolAPI creates a PoolAPI for the pools of the exporter.
+func NewPoolAPI(e *Exporter, token string) *PoolAPI {
+	return &PoolAPI{exporter: e, token: token}
+}
+
+// apiPool is the representation of a pool in the PoolAPI.
+type apiPool struct {
+	Address        string            `json:"address"`
+	Name           string            `json:"name,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	DiscoveredBy   string            `json:"discovered_by,omitempty"`
+	Up             bool              `json:"up"`
+	LastScrape     *time.Time        `json:"last_scrape,omitempty"`
+	ScrapeError    string            `json:"scrape_error,omitempty"`
+	ScrapeFailures int64             `json:"scrape_failures"`
+}
+
+func newAPIPool(p Pool) apiPool {
+	pool := apiPool{
+		Address:        RedactAddress(p.Address),
+		Name:           p.Name,
+		Labels:         p.Labels,
+		DiscoveredBy:   RedactAddress(p.DiscoveredBy),
+		Up:             !p.LastScrape.IsZero() && p.ScrapeError == nil,
+		ScrapeFailures: p.ScrapeFailures,
+	}
+
+	if p.Options != nil && p.Options.Name != "" {
+		pool.Name = p.Options.Name
+	}
+
+	if !p.LastScrape.IsZero() {
+		pool.LastScrape = &p.LastScrape
+	}
+
+	if p.ScrapeError != nil {
+		pool.ScrapeError = p.ScrapeError.Error()
+	}
+
+	return pool
+}
+
+// ServeHTTP handles the requests to /api/v1/pools.
+func (api *PoolAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		api.list(w)
+	case http.MethodPost:
+		api.add(w, r)
+	case http.MethodDelete:
+		api.remove(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+func (api *PoolAPI) authorized(r *http.Request) bool {
+	return hasBearerToken(r, api.token)
+}
+
+// RequireBearerToken wraps the handler so that requests have to send the token as bearer token, like requests to the
+// PoolAPI. Without a token every request is rejected.
+func RequireBearerToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether the request sends the token as bearer token.
+func hasBearerToken(r *http.Request, token string) bool {
+	sent, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+func (api *PoolAPI) list(w http.ResponseWriter) {
+	pools := []apiPool{}
+	for _, h := range api.exporter.PoolManager.List() {
+		if p, ok := h.Pool(); ok {
+			pools = append(pools, newAPIPool(p))
+		}
+	}
+
+	writeAPIResponse(w, http.StatusOK, pools)
+}
+
+func (api *PoolAPI) add(w http.ResponseWriter, r *http.Request) {
+	pc := PoolConfig{}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&pc); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid pool: %w", err))
+		return
+	}
+
+	h, err := api.exporter.AddPool(pc)
+	switch {
+	case errors.Is(err, ErrPoolExists):
+		writeAPIError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	log.Infof("Added pool %v via API", RedactAddress(pc.Address))
+
+	p, _ := h.Pool()
+	writeAPIResponse(w, http.StatusCreated, newAPIPool(p))
+}
+
+func (api *PoolAPI) remove(w http.ResponseWriter, r *http.Request) {
+	address := r.URL.Query().Get("address")
+	if address == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("address parameter is missing"))
+		return
+	}
+
+	h, ok := api.handle(address)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%w: %v", ErrPoolNotFound, RedactAddress(address)))
+		return
+	}
+
+	if err := api.exporter.RemovePool(h); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, ErrPoolNotFound) {
+			status = http.StatusNotFound
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+
+	log.Infof("Removed pool %v via API", RedactAddress(h.Address()))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handle returns the handle of the pool with the given address. As the API only returns redacted addresses,
+// pools can be referred to by their redacted address as well.
+func (api *PoolAPI) handle(address string) (PoolHandle, bool) {
+	if h, ok := api.exporter.PoolManager.Handle(address); ok {
+		return h, true
+	}
+
+	for _, h := range api.exporter.PoolManager.List() {
+		if RedactAddress(h.Address()) == address {
+			return h, true
+		}
+	}
+
+	return PoolHandle{}, false
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write API response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResponse(w, status, map[string]string{"error": err.Error()})
+}
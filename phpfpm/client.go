@@ -0,0 +1,503 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Status is the status page of a PHP-FPM pool at the time it was fetched. A Status is never modified once it has
+// been returned, so it can be shared between goroutines without locking.
+type Status struct {
+	Name                string        `json:"pool"`
+	ProcessManager      string        `json:"process manager"`
+	StartTime           timestamp     `json:"start time"`
+	StartSince          int64         `json:"start since"`
+	AcceptedConnections int64         `json:"accepted conn"`
+	ListenQueue         int64         `json:"listen queue"`
+	MaxListenQueue      int64         `json:"max listen queue"`
+	ListenQueueLength   int64         `json:"listen queue len"`
+	IdleProcesses       int64         `json:"idle processes"`
+	ActiveProcesses     int64         `json:"active processes"`
+	TotalProcesses      int64         `json:"total processes"`
+	MaxActiveProcesses  int64         `json:"max active processes"`
+	MaxChildrenReached  int64         `json:"max children reached"`
+	SlowRequests        int64         `json:"slow requests"`
+	Processes           []PoolProcess `json:"processes"`
+	// SkippedProcesses is the number of processes which couldn't be decoded and are missing from Processes.
+	SkippedProcesses int64 `json:"-"`
+
+	// skipError is the reason the last of the SkippedProcesses couldn't be decoded.
+	skipError error
+}
+
+// Client fetches the status pages of PHP-FPM pools. The connections to every target, e.g. persistent connections
+// with the keepalive option, are kept between fetches, so a Client should be reused. They are kept until CloseTarget
+// or Close is called, which callers fetching changing targets must do once a target is no longer fetched.
+// The zero value is ready to use and a Client is safe for concurrent use.
+type Client struct {
+	// KeepAlive enables persistent connections for targets whose scrape URI doesn't set the keepalive option.
+	KeepAlive bool
+
+	mutex     sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+// endpoint is the state of a single target which is kept between fetches. Fetches of the same target are
+// serialized, as a persistent FastCGI connection handles one request at a time.
+type endpoint struct {
+	mutex  sync.Mutex
+	target string
+	opts   *PoolOptions
+
+	// conn is the persistent FastCGI connection if Options.KeepAlive is enabled.
+	conn     *fcgiConn
+	connLost bool
+	// client scrapes pools with an http, https or http+unix scrape URI.
+	client *http.Client
+	// openMetricsUnsupported is set once PHP-FPM ignored a request for the OpenMetrics format.
+	openMetricsUnsupported bool
+	// stats collects the side effects of the fetch in progress.
+	stats *fetchStats
+}
+
+// fetchStats are the side effects of a fetch which are of interest even if the fetch failed.
+type fetchStats struct {
+	// lastStderr is the last line PHP-FPM wrote to stderr.
+	lastStderr  string
+	reconnects  int64
+	jsonRepairs int64
+}
+
+// Fetch retrieves the status page of the target, a scrape URI like tcp://127.0.0.1:9000/status?timeout=5s whose
+// query parameters are parsed as PoolOptions. Transient errors are retried as configured by the options.
+// Every call returns a new Status.
+func (c *Client) Fetch(ctx context.Context, target string) (*Status, error) {
+	defaults := DefaultPoolOptions
+	defaults.KeepAlive = c.KeepAlive
+
+	opts, err := ParsePoolOptions(target, defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.fetch(ctx, target, &opts, &fetchStats{})
+}
+
+// fetch retrieves the status page of the target with the given options and records the side effects in stats.
+func (c *Client) fetch(ctx context.Context, target string, opts *PoolOptions, stats *fetchStats) (status *Status, err error) {
+	e := c.endpoint(target)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.opts = opts
+	e.stats = stats
+	defer func() { e.stats = nil }()
+
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 {
+			delay := opts.retryDelay(attempt)
+			log.Debugf("Pool[%v]: retrying scrape (%d/%d) in %v after error: %v", RedactAddress(target), attempt, opts.Retries, delay, err)
+
+			if wait(ctx, delay) != nil {
+				break
+			}
+		}
+
+		if status, err = e.scrape(ctx); err == nil || ctx.Err() != nil || !isTransient(err) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Name != "" {
+		status.Name = opts.Name
+	}
+
+	return status, nil
+}
+
+// endpoint returns the state of the target, which is created on first use.
+func (c *Client) endpoint(target string) *endpoint {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.endpoints == nil {
+		c.endpoints = map[string]*endpoint{}
+	}
+
+	e, ok := c.endpoints[target]
+	if !ok {
+		e = &endpoint{target: target}
+		c.endpoints[target] = e
+	}
+
+	return e
+}
+
+// CloseTarget closes the connections to the target and forgets everything learned about it. It doesn't wait for
+// a fetch of the target in progress, whose connection is closed once it is done. A later fetch starts afresh.
+func (c *Client) CloseTarget(target string) {
+	c.mutex.Lock()
+	e, ok := c.endpoints[target]
+	delete(c.endpoints, target)
+	c.mutex.Unlock()
+
+	if ok {
+		go e.close()
+	}
+}
+
+// Close closes the connections to all targets.
+func (c *Client) Close() {
+	c.mutex.Lock()
+	endpoints := c.endpoints
+	c.endpoints = nil
+	c.mutex.Unlock()
+
+	for _, e := range endpoints {
+		e.close()
+	}
+}
+
+// scrape runs a single attempt to retrieve the status page.
+func (e *endpoint) scrape(ctx context.Context) (*Status, error) {
+	if e.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.opts.Timeout)
+		defer cancel()
+	}
+
+	scheme, address, path, err := parseURL(e.target)
+	if err != nil {
+		return nil, err
+	}
+
+	format := e.opts.Format
+	if format == FormatOpenMetrics && e.openMetricsUnsupported {
+		format = FormatJSON
+	}
+
+	body, err := e.fetch(ctx, scheme, address, path, formatQuery(format, e.opts.Full))
+	if err != nil {
+		return nil, err
+	}
+
+	if format == FormatOpenMetrics && !isOpenMetrics(body) {
+		log.Infof("Pool[%v]: PHP-FPM doesn't support OpenMetrics, falling back to JSON", RedactAddress(e.target))
+		e.openMetricsUnsupported = true
+		format = FormatJSON
+
+		_ = body.Close()
+		if body, err = e.fetch(ctx, scheme, address, path, formatQuery(format, e.opts.Full)); err != nil {
+			return nil, err
+		}
+	}
+
+	status, repairs, err := decodeStatus(format, body)
+	closeErr := body.Close()
+	e.stats.jsonRepairs += int64(repairs)
+	if err != nil {
+		err = fmt.Errorf("unable to decode %v status page: %w", format, err)
+		if ErrorReason(err) == ReasonOther {
+			err = &ScrapeError{Reason: ReasonParse, Err: err}
+		}
+		return nil, err
+	}
+
+	if closeErr != nil {
+		return nil, closeErr
+	}
+
+	log.Debugf("Pool[%v]: decoded %v status page of %d bytes with %d processes", RedactAddress(e.target), format, body.read, len(status.Processes))
+
+	if status.SkippedProcesses > 0 {
+		log.Infof("Pool[%v]: skipped %d processes which couldn't be decoded: %v", RedactAddress(e.target), status.SkippedProcesses, status.skipError)
+	}
+
+	return status, nil
+}
+
+// statusBody is the status page which is read while it is decoded. Reading fails once it exceeds the
+// maximum response size.
+type statusBody struct {
+	*bufio.Reader
+	*limitedReader
+	io.Closer
+}
+
+func (b statusBody) Read(p []byte) (int, error) {
+	return b.Reader.Read(p)
+}
+
+// fetch requests the status page with the given query string via HTTP or FastCGI depending on the scheme.
+func (e *endpoint) fetch(ctx context.Context, scheme string, address string, path string, query string) (*statusBody, error) {
+	var body io.ReadCloser
+	var err error
+
+	if isHTTPScheme(scheme) {
+		body, err = e.requestHTTP(ctx, scheme, address, path, query)
+	} else {
+		body, err = e.requestStatus(ctx, scheme, address, path, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	limited := &limitedReader{r: body, max: e.opts.maxResponseSize()}
+
+	return &statusBody{Reader: bufio.NewReader(limited), limitedReader: limited, Closer: body}, nil
+}
+
+// requestStatus retrieves the status page via FastCGI and returns the body, which is received while it is read.
+// The output of PHP-FPM is limited to the maximum response size.
+func (e *endpoint) requestStatus(ctx context.Context, scheme string, address string, path string, query string) (io.ReadCloser, error) {
+	env := map[string]string{
+		"SCRIPT_FILENAME": path,
+		"SCRIPT_NAME":     path,
+		"SERVER_SOFTWARE": "go / php-fpm_exporter",
+		"REMOTE_ADDR":     "127.0.0.1",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_METHOD":  "GET",
+		"CONTENT_LENGTH":  "0",
+		"QUERY_STRING":    query,
+	}
+
+	resp, err := e.request(ctx, scheme, address, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// PHP-FPM responds with "File not found." if the path isn't the pm.status_path of the pool and with
+	// "Access denied." if security.limit_extensions doesn't allow it.
+	if status := resp.StatusCode(); status != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		stderr := e.recordStderr(resp)
+		err := fmt.Errorf("PHP-FPM responded to %v with status %q: %s%v", path, resp.Header.Get("Status"), firstLine(body), stderrSuffix(stderr))
+
+		switch status {
+		case http.StatusNotFound:
+			return nil, &ScrapeError{Reason: ReasonNotFound, Err: err}
+		case http.StatusForbidden:
+			return nil, &ScrapeError{Reason: ReasonAccessDenied, Err: err}
+		}
+		return nil, err
+	}
+
+	return &fcgiStatusBody{resp: resp, e: e}, nil
+}
+
+// fcgiStatusBody is a status page received via FastCGI. The stderr output and the app status of PHP-FPM follow the
+// status page, so they are checked once it is closed.
+type fcgiStatusBody struct {
+	resp *fcgiResponse
+	e    *endpoint
+}
+
+func (b *fcgiStatusBody) Read(p []byte) (int, error) {
+	return b.resp.Body.Read(p)
+}
+
+func (b *fcgiStatusBody) Close() error {
+	if err := b.resp.Body.Close(); err != nil {
+		return err
+	}
+
+	stderr := b.e.recordStderr(b.resp)
+	if b.resp.AppStatus != 0 {
+		return fmt.Errorf("PHP-FPM finished the request with app status %d%v", b.resp.AppStatus, stderrSuffix(stderr))
+	}
+
+	return nil
+}
+
+// recordStderr records the last line PHP-FPM wrote to stderr in the stats and returns it.
+func (e *endpoint) recordStderr(resp *fcgiResponse) string {
+	stderr := resp.LastStderr()
+	e.stats.lastStderr = stderr
+	if stderr != "" {
+		log.Debugf("Pool[%v]: PHP-FPM wrote to stderr: %v", RedactAddress(e.target), stderr)
+	}
+
+	return stderr
+}
+
+// firstLine returns the first line of the body, shortened to be part of an error message.
+func firstLine(body []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(body), []byte("\n"))
+	if len(line) > 200 {
+		line = append(line[:200:200], "..."...)
+	}
+
+	return string(bytes.TrimSpace(line))
+}
+
+// stderrSuffix appends the stderr output of PHP-FPM to error messages.
+func stderrSuffix(stderr string) string {
+	if stderr == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" (stderr: %v)", stderr)
+}
+
+// request sends the FastCGI request to PHP-FPM. With Options.KeepAlive the persistent connection is reused
+// and re-established once if it turns out to be broken. The connection is released once the body is closed.
+func (e *endpoint) request(ctx context.Context, network string, address string, env map[string]string) (*fcgiResponse, error) {
+	if !e.opts.KeepAlive {
+		fcgi, err := e.dialFCGI(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := fcgi.Do(ctx, env, false, e.opts.maxResponseSize())
+		if err != nil {
+			_ = fcgi.Close()
+			return nil, err
+		}
+
+		resp.Body = &fcgiBody{ReadCloser: resp.Body, release: func(error) { _ = fcgi.Close() }}
+
+		return resp, nil
+	}
+
+	reused := e.conn != nil
+	if !reused {
+		if err := e.connect(ctx, network, address); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := e.conn.Do(ctx, env, true, e.opts.maxResponseSize())
+	if err != nil && reused && ctx.Err() == nil {
+		// PHP-FPM might have closed the idle connection in the meantime, e.g. due to a restart.
+		log.Debugf("Pool[%v]: persistent connection broken, reconnecting: %v", RedactAddress(e.target), err)
+		e.disconnect()
+
+		if err = e.connect(ctx, network, address); err != nil {
+			return nil, err
+		}
+
+		resp, err = e.conn.Do(ctx, env, true, e.opts.maxResponseSize())
+	}
+
+	if err != nil {
+		e.disconnect()
+		return nil, err
+	}
+
+	conn := e.conn
+	resp.Body = &fcgiBody{ReadCloser: resp.Body, release: func(err error) {
+		// The rest of a failed response might still arrive on the connection.
+		if err != nil && e.conn == conn {
+			e.disconnect()
+		}
+	}}
+
+	return resp, nil
+}
+
+// fcgiBody releases the connection of a FastCGI response once its body is closed.
+type fcgiBody struct {
+	io.ReadCloser
+	release func(err error)
+}
+
+func (b *fcgiBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release(err)
+
+	return err
+}
+
+// dialFCGI connects to PHP-FPM, through the proxy of the Options if any. Connections of tcps scrape URIs are
+// encrypted with the TLS settings of the Options. Certificates are loaded on every dial so that renewed ones are picked up.
+func (e *endpoint) dialFCGI(ctx context.Context, network string, address string) (*fcgiConn, error) {
+	proxy, err := e.opts.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	if network != "tcps" {
+		return dialFCGI(ctx, network, address, proxy, nil)
+	}
+
+	tlsConfig, err := e.opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	return dialFCGI(ctx, "tcp", address, proxy, tlsConfig)
+}
+
+// connect establishes the persistent connection.
+func (e *endpoint) connect(ctx context.Context, network string, address string) error {
+	fcgi, err := e.dialFCGI(ctx, network, address)
+	if err != nil {
+		return err
+	}
+
+	if e.connLost {
+		e.stats.reconnects++
+		e.connLost = false
+	}
+
+	e.conn = fcgi
+
+	return nil
+}
+
+// disconnect closes the persistent connection so that the next scrape reconnects.
+func (e *endpoint) disconnect() {
+	if e.conn == nil {
+		return
+	}
+
+	_ = e.conn.Close()
+	e.conn = nil
+	e.connLost = true
+}
+
+// close closes the persistent connection and the idle HTTP connections, waiting for a fetch in progress.
+func (e *endpoint) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn != nil {
+		_ = e.conn.Close()
+		e.conn = nil
+	}
+
+	if e.client != nil {
+		e.client.CloseIdleConnections()
+		e.client = nil
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientFetch(t *testing.T) {
+	var accepted atomic.Int64
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Replace(statusJSON, `"accepted conn":1577112`, fmt.Sprintf(`"accepted conn":%d`, accepted.Add(1)), 1)))
+	}))
+
+	c := &Client{}
+	defer c.Close()
+
+	first, err := c.Fetch(context.Background(), "tcp://"+address+"/status")
+	require.NoError(t, err)
+	assert.Equal(t, "www", first.Name)
+	assert.Equal(t, int64(1), first.AcceptedConnections)
+	require.Len(t, first.Processes, 2)
+
+	second, err := c.Fetch(context.Background(), "tcp://"+address+"/status?name=api")
+	require.NoError(t, err)
+	assert.Equal(t, "api", second.Name)
+	assert.Equal(t, int64(2), second.AcceptedConnections)
+	assert.Equal(t, int64(1), first.AcceptedConnections, "a Status isn't modified by later fetches")
+
+	_, err = c.Fetch(context.Background(), "tcp://"+address+"/status?timeout=soon")
+	assert.Error(t, err)
+
+	_, err = c.Fetch(context.Background(), "tcp://"+closedAddress(t)+"/status")
+	assert.Equal(t, ReasonDialRefused, ErrorReason(err))
+}
+
+func TestClientFetchConcurrent(t *testing.T) {
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	c := &Client{KeepAlive: true}
+	defer c.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				status, err := c.Fetch(context.Background(), "tcp://"+address+"/status")
+				if assert.NoError(t, err) {
+					assert.Len(t, status.Processes, 2)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClientCloseTarget(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+	target := "tcp://" + address + "/status?keepalive=true"
+
+	c := &Client{}
+	defer c.Close()
+
+	_, err := c.Fetch(context.Background(), target)
+	require.NoError(t, err)
+	require.Contains(t, c.endpoints, target)
+
+	c.CloseTarget(target)
+	assert.NotContains(t, c.endpoints, target, "the state of closed targets isn't kept")
+
+	_, err = c.Fetch(context.Background(), target)
+	require.NoError(t, err)
+	assert.Contains(t, c.endpoints, target)
+}
+
+func TestPoolManagerUpdateReplacesStatus(t *testing.T) {
+	var down atomic.Bool
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	pm := PoolManager{}
+	h := pm.Add("tcp://" + address + "/status")
+	defer pm.Close()
+
+	require.NoError(t, pm.Update())
+	before, ok := h.Pool()
+	require.True(t, ok)
+	require.Len(t, before.Processes, 2)
+
+	// Copies share the processes with the pool, which don't race with updates as they are never modified in place.
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			CountProcessState(before.Processes)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, pm.Update())
+	}
+	wg.Wait()
+
+	down.Store(true)
+	require.NoError(t, pm.Update())
+
+	after, _ := h.Pool()
+	assert.Error(t, after.ScrapeError)
+	assert.Equal(t, before.Status.Name, after.Status.Name, "the status of the last successful scrape is kept")
+	assert.Same(t, pm.Client, after.client, "pools share the client of the manager")
+}
+
+func TestPoolScrapeReturnsNewValue(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	p := Pool{Address: "tcp://" + address + "/status", ScrapeErrors: map[string]int64{ReasonDialRefused: 1}, client: &Client{}}
+	defer p.Close()
+
+	next, err := p.scrape(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "www", next.Name)
+	assert.NotNil(t, next.Options)
+	assert.False(t, next.LastScrape.IsZero())
+
+	assert.Empty(t, p.Name, "the scraped pool isn't modified")
+	assert.Nil(t, p.Options)
+	assert.True(t, p.LastScrape.IsZero())
+
+	p.Address = "tcp://" + closedAddress(t) + "/status"
+	next, err = p.scrape(context.Background())
+	require.Error(t, err)
+	assert.Equal(t, int64(2), next.ScrapeErrors[ReasonDialRefused])
+	assert.Equal(t, int64(1), p.ScrapeErrors[ReasonDialRefused], "the errors of the scraped pool aren't modified")
+	assert.Nil(t, p.ScrapeError)
+}
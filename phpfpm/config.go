@@ -0,0 +1,236 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// GroupLabel is the label exposing the name of the group a pool belongs to.
+const GroupLabel = "group"
+
+// reservedLabels are used by the exporter itself and can't be configured as static labels.
+var reservedLabels = labelSet(poolLabelNames, processLabelNames, stateLabelNames, pmLabelNames, reasonLabelNames,
+	discoveredLabelNames)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config describes the pools to scrape, e.g. as read from the configuration file:
+//
+//	pools:
+//	  - address: tcp://127.0.0.1:9000/status
+//	    name: api
+//	    labels:
+//	      env: production
+//	groups:
+//	  - name: shop
+//	    labels:
+//	      team: checkout
+//	    pools:
+//	      - address: unix:///run/php/shop.sock;/status
+type Config struct {
+	Pools  []PoolConfig  `mapstructure:"pools"`
+	Groups []GroupConfig `mapstructure:"groups"`
+}
+
+// PoolConfig describes a single pool.
+type PoolConfig struct {
+	// Address is the scrape URI of the pool including options, see PoolOptions.
+	Address string `json:"address" mapstructure:"address"`
+	// Name overrides the pool name reported by PHP-FPM.
+	Name string `json:"name" mapstructure:"name"`
+	// Labels are static labels attached to every metric of the pool.
+	Labels map[string]string `json:"labels" mapstructure:"labels"`
+}
+
+// GroupConfig shares static labels between pools. The name of the group is exposed as "group" label.
+type GroupConfig struct {
+	Name   string            `mapstructure:"name"`
+	Labels map[string]string `mapstructure:"labels"`
+	Pools  []PoolConfig      `mapstructure:"pools"`
+}
+
+// Validate checks the configuration and returns all problems found.
+func (c *Config) Validate() error {
+	var errs []error
+
+	addresses := map[string]string{}
+	validatePool := func(location string, pool PoolConfig) {
+		if err := pool.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", location, err))
+		}
+
+		if _, ok := pool.Labels[GroupLabel]; ok {
+			errs = append(errs, fmt.Errorf("%v: label '%v' is reserved, use groups instead", location, GroupLabel))
+		}
+
+		if other, ok := addresses[pool.Address]; ok {
+			errs = append(errs, fmt.Errorf("%v: address %v is already used by %v", location, RedactAddress(pool.Address), other))
+		}
+		addresses[pool.Address] = location
+	}
+
+	for idx, pool := range c.Pools {
+		validatePool(fmt.Sprintf("pools[%d]", idx), pool)
+	}
+
+	groups := map[string]bool{}
+	for idx, group := range c.Groups {
+		location := fmt.Sprintf("groups[%d]", idx)
+
+		switch {
+		case group.Name == "":
+			errs = append(errs, fmt.Errorf("%v: name is required", location))
+		case groups[group.Name]:
+			errs = append(errs, fmt.Errorf("%v: group %v is defined more than once", location, group.Name))
+		}
+		groups[group.Name] = true
+
+		if err := validateLabels(group.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", location, err))
+		}
+
+		if _, ok := group.Labels[GroupLabel]; ok {
+			errs = append(errs, fmt.Errorf("%v: label '%v' is reserved for the group name", location, GroupLabel))
+		}
+
+		for poolIdx, pool := range group.Pools {
+			validatePool(fmt.Sprintf("%v.pools[%d]", location, poolIdx), pool)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// PoolConfigs returns all pools including the ones of groups. Pools of a group inherit its labels.
+func (c *Config) PoolConfigs() []PoolConfig {
+	pools := append([]PoolConfig(nil), c.Pools...)
+
+	for _, group := range c.Groups {
+		for _, pool := range group.Pools {
+			labels := map[string]string{GroupLabel: group.Name}
+			for name, value := range group.Labels {
+				labels[name] = value
+			}
+			for name, value := range pool.Labels {
+				labels[name] = value
+			}
+
+			pool.Labels = labels
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools
+}
+
+func (pc PoolConfig) validate() error {
+	if pc.Address == "" {
+		return errors.New("address is required")
+	}
+
+	uri, err := url.Parse(pc.Address)
+	if err != nil {
+		// The error of url.Parse contains the address including its password.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = RedactAddress(urlErr.URL)
+		}
+		return fmt.Errorf("invalid address: %w", err)
+	}
+
+	if uri.Scheme != "tcp" && uri.Scheme != "tcps" && uri.Scheme != "unix" && !isHTTPScheme(uri.Scheme) {
+		return fmt.Errorf("address %v must start with tcp://, tcps://, unix://, http://, https:// or http+unix://", RedactAddress(pc.Address))
+	}
+
+	if pattern, ok := socketPattern(pc.Address); ok {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %v: %w", pattern, err)
+		}
+	}
+
+	if _, err := ParsePoolOptions(pc.Address, DefaultPoolOptions); err != nil {
+		return err
+	}
+
+	return validateLabels(pc.Labels)
+}
+
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name '%v'", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label '%v' is reserved", name)
+		}
+	}
+
+	return nil
+}
+
+// labelSet returns the set of the given label names.
+func labelSet(names ...[]string) map[string]bool {
+	set := map[string]bool{}
+	for _, names := range names {
+		for _, name := range names {
+			set[name] = true
+		}
+	}
+
+	return set
+}
+
+// AddConfig will add a pool to the pool manager based on the given configuration.
+// Adding an address which is already managed fails with ErrPoolExists.
+func (pm *PoolManager) AddConfig(pc PoolConfig) (PoolHandle, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if _, err := pm.addConfig(pc); err != nil {
+		return PoolHandle{}, err
+	}
+
+	return PoolHandle{pm: pm, address: pc.Address}, nil
+}
+
+// addConfig appends the pool and returns a pointer to the new element of pm.Pools or pm.Globs.
+func (pm *PoolManager) addConfig(pc PoolConfig) (*Pool, error) {
+	if err := pc.validate(); err != nil {
+		return nil, err
+	}
+
+	if pm.lookup(pc.Address) != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPoolExists, RedactAddress(pc.Address))
+	}
+
+	defaults := DefaultPoolOptions
+	defaults.KeepAlive = pm.KeepAlive
+
+	opts, err := ParsePoolOptions(pc.Address, defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.Name != "" {
+		opts.Name = pc.Name
+	}
+
+	return pm.appendPool(Pool{Address: pc.Address, Options: &opts, Labels: pc.Labels}), nil
+}
@@ -0,0 +1,97 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := Config{
+		Pools: []PoolConfig{
+			{Address: "tcp://127.0.0.1:9000/status", Labels: map[string]string{"env": "prod"}},
+			{Address: "tcp://127.0.0.1:9000/status"},
+			{Address: "127.0.0.1:9001"},
+			{Address: "tcp://127.0.0.1:9002/status?timeout=abc"},
+			{Address: "tcp://127.0.0.1:9003/status", Labels: map[string]string{"pool": "x"}},
+			{Address: "tcp://127.0.0.1:9004/status", Labels: map[string]string{"my-label": "x"}},
+			{Address: "tcp://127.0.0.1:9005/status", Labels: map[string]string{"reason": "x"}},
+		},
+		Groups: []GroupConfig{
+			{Pools: []PoolConfig{{}}},
+		},
+	}
+
+	err := cfg.Validate()
+
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"pools[1]: address tcp://127.0.0.1:9000/status is already used by pools[0]",
+		"pools[2]: invalid address: parse \"127.0.0.1:9001\": first path segment in URL cannot contain colon",
+		"pools[3]: invalid value 'abc' for option 'timeout' in scrape URI tcp://127.0.0.1:9002/status?timeout=abc: time: invalid duration \"abc\"",
+		"pools[4]: label 'pool' is reserved",
+		"pools[5]: invalid label name 'my-label'",
+		"pools[6]: label 'reason' is reserved",
+		"groups[0]: name is required",
+		"groups[0].pools[0]: address is required",
+	}, strings.Split(err.Error(), "\n"))
+}
+
+func TestConfigPoolConfigs(t *testing.T) {
+	cfg := Config{
+		Pools: []PoolConfig{
+			{Address: "tcp://127.0.0.1:9000/status", Name: "api"},
+		},
+		Groups: []GroupConfig{
+			{
+				Name:   "shop",
+				Labels: map[string]string{"team": "checkout", "env": "prod"},
+				Pools: []PoolConfig{
+					{Address: "tcp://127.0.0.1:9001/status", Labels: map[string]string{"env": "staging"}},
+				},
+			},
+		},
+	}
+
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, []PoolConfig{
+		{Address: "tcp://127.0.0.1:9000/status", Name: "api"},
+		{Address: "tcp://127.0.0.1:9001/status", Labels: map[string]string{"group": "shop", "team": "checkout", "env": "staging"}},
+	}, cfg.PoolConfigs())
+}
+
+func TestExporterStaticLabels(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	pm := PoolManager{}
+	_, err := pm.AddConfig(PoolConfig{Address: "tcp://" + address + "/status", Name: "api", Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+	_, err = pm.AddConfig(PoolConfig{Address: "tcp://" + address + "/status?retries=1", Labels: map[string]string{"team": "web"}})
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf(`
+# HELP phpfpm_up Could PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up{env="prod",pool="api",scrape_uri="tcp://%[1]v/status",team=""} 1
+phpfpm_up{env="",pool="www",scrape_uri="tcp://%[1]v/status?retries=1",team="web"} 1
+`, address)
+
+	assert.NoError(t, testutil.CollectAndCompare(NewExporter(&pm), strings.NewReader(expected), "phpfpm_up"))
+}
@@ -0,0 +1,353 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// DefaultMaxResponseSize limits the size of status pages unless the scrape URI sets `max_response_size`.
+const DefaultMaxResponseSize int64 = 16 << 20
+
+// ErrResponseTooLarge is returned if a status page exceeds the maximum response size of the pool.
+var ErrResponseTooLarge = errors.New("response exceeds the maximum size")
+
+// keyLookahead is the number of bytes searched for the next key after a quote in a string value.
+const keyLookahead = 128
+
+// nextKeys maps the string values of processes which come from HTTP clients to the key PHP-FPM writes next. They must
+// only end at a quote followed by that key, otherwise a request URI like /x","requests":1,"y":" would add keys to its
+// process.
+var nextKeys = map[string]string{
+	"request method": "request uri",
+	"request uri":    "content length",
+	"user":           "script",
+	"script":         "last request cpu",
+}
+
+// limitedReader fails with ErrResponseTooLarge once more than max bytes are read.
+type limitedReader struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if l.read > l.max {
+		return 0, fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, l.max)
+	}
+
+	// Read one byte more than allowed to detect that the limit is exceeded.
+	if remaining := l.max - l.read + 1; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	n, err := l.r.Read(b)
+	l.read += int64(n)
+
+	if l.read > l.max {
+		return n - int(l.read-l.max), fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, l.max)
+	}
+
+	return n, err
+}
+
+// jsonRepairReader repairs the JSON of the PHP-FPM status page while it is read. PHP-FPM doesn't escape string
+// values, so quotes, backslashes and control characters in them are escaped. Backslashes which don't start a valid
+// escape sequence are taken literally and invalid UTF-8 is replaced by U+FFFD.
+type jsonRepairReader struct {
+	r   *bufio.Reader
+	out bytes.Buffer
+	err error
+
+	// prev is the last byte outside of strings except whitespace. A string following a colon is a value.
+	prev byte
+	// key is the last key, whose value is read next.
+	key string
+	// repairs is the number of strings which had to be repaired.
+	repairs int
+}
+
+func newJSONRepairReader(r io.Reader) *jsonRepairReader {
+	return &jsonRepairReader{r: bufio.NewReader(r)}
+}
+
+func (j *jsonRepairReader) Read(b []byte) (int, error) {
+	for j.out.Len() < len(b) && j.err == nil {
+		j.err = j.next()
+	}
+
+	if j.out.Len() > 0 {
+		return j.out.Read(b)
+	}
+
+	return 0, j.err
+}
+
+// next repairs the next token, which is either a single byte outside of strings or a complete string.
+func (j *jsonRepairReader) next() error {
+	c, err := j.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if c != '"' {
+		j.out.WriteByte(c)
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			j.prev = c
+		}
+		return nil
+	}
+
+	isValue := j.prev == ':'
+	j.prev = '"'
+
+	start := j.out.Len()
+	repaired, err := j.string(isValue)
+	if repaired {
+		j.repairs++
+	}
+
+	// Keys are escaped properly, so they can be taken as they are.
+	if err == nil && !isValue {
+		j.key = string(j.out.Bytes()[start+1 : j.out.Len()-1])
+	}
+
+	return err
+}
+
+// string copies a string and repairs it if necessary. Keys are escaped properly by PHP-FPM, so they end at the next
+// quote. A value ends at the quote which is followed by the next key, see endsValue.
+func (j *jsonRepairReader) string(isValue bool) (bool, error) {
+	repaired := false
+	j.out.WriteByte('"')
+
+	for {
+		r, size, err := j.r.ReadRune()
+		if err != nil {
+			return repaired, unexpectedEOF(err)
+		}
+
+		switch {
+		case r == '"':
+			if !isValue || j.endsValue() {
+				j.out.WriteByte('"')
+				return repaired, nil
+			}
+			j.out.WriteString(`\"`)
+			repaired = true
+		case r == '\\':
+			escaped, end := j.escape(isValue)
+			repaired = repaired || !escaped
+			if end {
+				return repaired, nil
+			}
+		case r < 0x20:
+			fmt.Fprintf(&j.out, `\u%04x`, r)
+			repaired = true
+		case r == utf8.RuneError && size == 1:
+			j.out.WriteRune(utf8.RuneError)
+			repaired = true
+		default:
+			j.out.WriteRune(r)
+		}
+	}
+}
+
+// escape copies the escape sequence following a backslash. If it isn't valid, the backslash is escaped instead.
+// An escaped quote which ends the value is a literal backslash at the end of the value.
+func (j *jsonRepairReader) escape(isValue bool) (escaped bool, end bool) {
+	next, _ := j.r.Peek(5)
+
+	switch {
+	case len(next) == 0:
+	case next[0] == '"':
+		_, _ = j.r.ReadByte()
+		if isValue && j.endsValue() {
+			j.out.WriteString(`\\"`)
+			return false, true
+		}
+		j.out.WriteString(`\"`)
+		return true, false
+	case bytes.IndexByte([]byte(`\/bfnrt`), next[0]) >= 0:
+		j.out.WriteByte('\\')
+		j.out.WriteByte(next[0])
+		_, _ = j.r.ReadByte()
+		return true, false
+	case next[0] == 'u' && len(next) == 5 && isHex(next[1:]):
+		j.out.WriteByte('\\')
+		j.out.Write(next)
+		_, _ = j.r.Discard(len(next))
+		return true, false
+	}
+
+	j.out.WriteString(`\\`)
+	return false, false
+}
+
+// endsValue reports whether the quote just read ends a value. Values of keys in nextKeys end at the quote followed by
+// their next key, other values at the quote followed by any key or the end of the object or array.
+func (j *jsonRepairReader) endsValue() bool {
+	expected, ordered := nextKeys[j.key]
+
+	next, err := j.r.Peek(keyLookahead)
+	rest := bytes.TrimLeft(next, " \t\r\n")
+
+	if len(rest) == 0 {
+		return err != nil && !ordered
+	}
+
+	switch rest[0] {
+	case '}', ']':
+		return !ordered
+	case ',':
+	default:
+		return false
+	}
+
+	rest = bytes.TrimLeft(rest[1:], " \t\r\n")
+	if len(rest) == 0 || rest[0] != '"' {
+		return false
+	}
+
+	end := bytes.IndexByte(rest[1:], '"')
+	if end < 0 || (ordered && string(rest[1:end+1]) != expected) {
+		return false
+	}
+
+	rest = bytes.TrimLeft(rest[end+2:], " \t\r\n")
+	return len(rest) > 0 && rest[0] == ':'
+}
+
+func isHex(b []byte) bool {
+	for _, c := range b {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decodeJSONStatus decodes the JSON status page. Processes are decoded one by one, so that only a single process
+// needs to be buffered instead of the whole status page. Processes which can't be decoded are skipped and counted in
+// SkippedProcesses instead of failing the whole pool. repairs is the number of malformed strings which had to be
+// repaired, even if decoding failed.
+func decodeJSONStatus(r io.Reader) (status *Status, repairs int, err error) {
+	repair := newJSONRepairReader(r)
+	status, err = decodeValidJSONStatus(repair)
+
+	return status, repair.repairs, err
+}
+
+// decodeValidJSONStatus decodes a JSON status page whose strings are valid, see decodeJSONStatus.
+func decodeValidJSONStatus(r io.Reader) (*Status, error) {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	var processes []PoolProcess
+	var skipped int64
+	var skipError error
+
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+
+		if key != "processes" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			fields[key] = value
+			continue
+		}
+
+		if err := expectDelim(dec, '['); err != nil {
+			return nil, err
+		}
+
+		processes = []PoolProcess{}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+
+			var process PoolProcess
+			if err := json.Unmarshal(raw, &process); err != nil {
+				skipped++
+				skipError = err
+				continue
+			}
+			processes = append(processes, process)
+		}
+
+		if err := expectDelim(dec, ']'); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+
+	// The pool fields are few and small, so they are decoded in one go.
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal(content, status); err != nil {
+		return nil, err
+	}
+
+	status.Processes = processes
+	status.SkippedProcesses = skipped
+	status.skipError = skipError
+
+	return status, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("invalid status page: expected %v, got %v", delim, token)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeStatusJSON returns a status page with the given number of processes whose request URIs aren't escaped.
+func largeStatusJSON(processes int) string {
+	var b strings.Builder
+
+	b.WriteString(`{"pool":"www","process manager":"static","start time":1528367006,"start since":15073840,"accepted conn":1577112,"listen queue":0,"max listen queue":0,"listen queue len":0,"idle processes":0,"active processes":` + fmt.Sprint(processes) + `,"total processes":` + fmt.Sprint(processes) + `,"max active processes":15,"max children reached":0,"slow requests":0,"processes":[`)
+	for i := 0; i < processes; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"pid":%d,"state":"Running","start time":1543354120,"start since":86726,"requests":853,"request duration":5721,"request method":"GET","request uri":"/search.php?q="%d"\path","content length":0,"user":"-","script":"/www/search.php","last request cpu":0.00,"last request memory":786432}`, i+1, i)
+	}
+	b.WriteString(`]}`)
+
+	return b.String()
+}
+
+func TestLimitedReader(t *testing.T) {
+	content, err := io.ReadAll(&limitedReader{r: strings.NewReader("0123456789"), max: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(content))
+
+	content, err = io.ReadAll(&limitedReader{r: strings.NewReader("0123456789"), max: 9})
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.Equal(t, "012345678", string(content))
+}
+
+func TestJSONRepairReader(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     string
+		repairs int
+	}{
+		{`{"request uri":"/index.php","content length":0}`, `{"request uri":"/index.php","content length":0}`, 0},
+		{`{"request uri":"/a"b"c","content length":0}`, `{"request uri":"/a\"b\"c","content length":0}`, 1},
+		{`{"request uri":"C:\path","content length":0}`, `{"request uri":"C:\\path","content length":0}`, 1},
+		{"{\"request uri\":\"/a\tb\",\"content length\":0}", `{"request uri":"/a\u0009b","content length":0}`, 1},
+		{`{"user":"a\"b","script":"/x","last request cpu":0}`, `{"user":"a\"b","script":"/x","last request cpu":0}`, 0},
+		{`{"request method":"request uri","request uri":"/"","content length":0}`, `{"request method":"request uri","request uri":"/\"","content length":0}`, 1},
+		{`{"processes":[{"request uri":"/","content length":0},{"request uri":"","content length":0}]}`, `{"processes":[{"request uri":"/","content length":0},{"request uri":"","content length":0}]}`, 0},
+		// Every string value is repaired, not only the request URI.
+		{`{"user":"-","script":"/www/"x".php","last request cpu":0}`, `{"user":"-","script":"/www/\"x\".php","last request cpu":0}`, 1},
+		{`{"user":"DOMAIN\user", "script":"-","last request cpu":0}`, `{"user":"DOMAIN\\user", "script":"-","last request cpu":0}`, 1},
+		{`{"request method":"G\u00e9T","request uri":"\/x\n","content length":0}`, `{"request method":"G\u00e9T","request uri":"\/x\n","content length":0}`, 0},
+		{`{"request method":"\u00zz","request uri":"/","content length":0}`, `{"request method":"\\u00zz","request uri":"/","content length":0}`, 1},
+		{`{"user":"/x\","script":"-","last request cpu":0}`, `{"user":"/x\\","script":"-","last request cpu":0}`, 1},
+		{`{"script":"/x\","last request cpu":0}`, `{"script":"/x\\","last request cpu":0}`, 1},
+		{"{\"user\":\"caf\xe9\",\"script\":\"\xff\xfe\",\"last request cpu\":0}", `{"user":"caf�","script":"��","last request cpu":0}`, 2},
+		{"{\"script\":\"/\u00e9\",\"last request cpu\":0}", "{\"script\":\"/\u00e9\",\"last request cpu\":0}", 0},
+		{`{"user" : "a" , "script" : "b" , "last request cpu" : 0 }`, `{"user" : "a" , "script" : "b" , "last request cpu" : 0 }`, 0},
+		// Values end only at the key PHP-FPM writes next, so request URIs can't add keys to their process.
+		{`{"request uri":"/x","requests":1e18,"y":"","content length":0}`, `{"request uri":"/x\",\"requests\":1e18,\"y\":\"","content length":0}`, 1},
+		{`{"request uri":"/x"}],"y":"","content length":0}`, `{"request uri":"/x\"}],\"y\":\"","content length":0}`, 1},
+		// Values of unknown keys end at any key.
+		{`{"x":"a"b","y":1}`, `{"x":"a\"b","y":1}`, 1},
+	}
+
+	for _, test := range tests {
+		repair := newJSONRepairReader(strings.NewReader(test.in))
+		out, err := io.ReadAll(repair)
+		assert.NoError(t, err, test.in)
+		assert.Equal(t, test.out, string(out), test.in)
+		assert.Equal(t, test.repairs, repair.repairs, test.in)
+		assert.True(t, json.Valid(out), test.in)
+	}
+
+	_, err := io.ReadAll(newJSONRepairReader(strings.NewReader(`{"request uri":"/index.php`)))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestPoolUpdateJSONRepairs(t *testing.T) {
+	status := strings.NewReplacer(`"script":"/www/index.php"`, `"script":"C:\www\index.php"`, `"user":"-"`, "\"user\":\"j\xf6rg\"").Replace(statusJSON)
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(status))
+	}))
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status")
+	e := NewExporter(&pm)
+
+	expected := `
+# HELP phpfpm_json_repairs_total The number of malformed strings in the JSON status page of PHP-FPM which had to be repaired.
+# TYPE phpfpm_json_repairs_total counter
+phpfpm_json_repairs_total{pool="www",scrape_uri="tcp://` + address + `/status"} 3
+`
+	require.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(expected), "phpfpm_json_repairs_total"))
+
+	p := pm.Pools[0]
+	assert.Equal(t, `C:\www\index.php`, p.Processes[1].Script)
+	assert.Equal(t, "j\ufffdrg", p.Processes[1].User)
+}
+
+func TestDecodeJSONStatus(t *testing.T) {
+	status, repairs, err := decodeJSONStatus(strings.NewReader(largeStatusJSON(1000)))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, repairs)
+	assert.Equal(t, "www", status.Name)
+	assert.Equal(t, int64(1000), status.TotalProcesses)
+	require.Len(t, status.Processes, 1000)
+	assert.Equal(t, `/search.php?q="999"\path`, status.Processes[999].RequestURI)
+
+	status, _, err = decodeJSONStatus(strings.NewReader(`{"pool":"www","accepted conn":1}`))
+	require.NoError(t, err)
+	assert.Nil(t, status.Processes, "status page without full")
+
+	for _, invalid := range []string{``, `[]`, `{"pool":"www"`, `{"pool":"www","processes":{}}`, `{"accepted conn":"many"}`, `{"processes":[{"pid":1]}`} {
+		_, _, err := decodeJSONStatus(strings.NewReader(invalid))
+		assert.Error(t, err, invalid)
+	}
+
+	_, repairs, err = decodeJSONStatus(strings.NewReader(`{"user":"C:\www","script":"-","last request cpu":0,"accepted conn":"many"}`))
+	assert.Error(t, err)
+	assert.Equal(t, 1, repairs, "repairs are counted even if decoding fails")
+}
+
+func TestDecodeJSONStatusSkipsProcesses(t *testing.T) {
+	status, _, err := decodeJSONStatus(strings.NewReader(`{"pool":"www","accepted conn":1,"processes":[{"pid":1},{"pid":"2"},{"pid":3,"requests":"many"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "www", status.Name)
+	assert.Equal(t, int64(1), status.AcceptedConnections)
+	require.Len(t, status.Processes, 1)
+	assert.Equal(t, int64(1), status.Processes[0].PID)
+	assert.Equal(t, int64(2), status.SkippedProcesses)
+	assert.Error(t, status.skipError)
+}
+
+func TestExporterPartialScrape(t *testing.T) {
+	status := strings.Replace(statusJSON, `"pid":15873`, `"pid":"15873"`, 1)
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(status))
+	}))
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status")
+	e := NewExporter(&pm)
+
+	labels := `{pool="www",scrape_uri="tcp://` + address + `/status"}`
+	expected := `
+# HELP phpfpm_accepted_connections The number of requests accepted by the pool.
+# TYPE phpfpm_accepted_connections counter
+phpfpm_accepted_connections` + labels + ` 1577112
+# HELP phpfpm_scrape_partial Whether processes of the last scrape of PHP-FPM were skipped because they couldn't be decoded.
+# TYPE phpfpm_scrape_partial gauge
+phpfpm_scrape_partial` + labels + ` 1
+# HELP phpfpm_skipped_processes The number of processes of the last scrape of PHP-FPM which couldn't be decoded.
+# TYPE phpfpm_skipped_processes gauge
+phpfpm_skipped_processes` + labels + ` 1
+# HELP phpfpm_up Could PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up` + labels + ` 1
+`
+	require.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(expected), "phpfpm_accepted_connections", "phpfpm_scrape_partial", "phpfpm_skipped_processes", "phpfpm_up"))
+	assert.Len(t, pm.Pools[0].Processes, 1)
+}
+
+func TestPoolUpdateMaxResponseSize(t *testing.T) {
+	status := largeStatusJSON(100)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(status))
+	})
+
+	address := listenFCGI(t, handler)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, uri := range []string{"tcp://" + address + "/status", srv.URL + "/fpm-status"} {
+		p := Pool{Address: uri}
+		require.NoError(t, p.Update(), uri)
+		assert.Len(t, p.Processes, 100, uri)
+
+		p = Pool{Address: uri + fmt.Sprintf("?max_response_size=%d", len(status)-1)}
+		assert.ErrorIs(t, p.Update(), ErrResponseTooLarge, uri)
+	}
+}
+
+func BenchmarkDecodeJSONStatus(b *testing.B) {
+	status := largeStatusJSON(5000)
+	b.SetBytes(int64(len(status)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeJSONStatus(strings.NewReader(status)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeJSONStatusRequestURIInjection(t *testing.T) {
+	status, repairs, err := decodeJSONStatus(strings.NewReader(`{"pool":"www","processes":[{"pid":1,"requests":2,"request method":"GET","request uri":"/x","requests":1e18,"y":"","content length":0,"user":"-","script":"/x","last request cpu":0}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1, repairs)
+	require.Len(t, status.Processes, 1)
+	assert.Equal(t, int64(2), status.Processes[0].Requests)
+	assert.Equal(t, `/x","requests":1e18,"y":"`, status.Processes[0].RequestURI)
+}
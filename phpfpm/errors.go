@@ -0,0 +1,103 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Reasons of failed scrapes, used as `reason` label of phpfpm_scrape_errors_total.
+const (
+	// ReasonDialRefused means nothing is listening on the address, i.e. PHP-FPM is down.
+	ReasonDialRefused = "dial_refused"
+	// ReasonDialTimeout means the connection to PHP-FPM couldn't be established in time.
+	ReasonDialTimeout = "dial_timeout"
+	// ReasonPermissionDenied means the exporter isn't allowed to connect to the socket.
+	ReasonPermissionDenied = "permission_denied"
+	// ReasonReadTimeout means PHP-FPM didn't respond in time once connected.
+	ReasonReadTimeout = "read_timeout"
+	// ReasonNotFound means PHP-FPM doesn't know the status path, e.g. pm.status_path isn't configured.
+	ReasonNotFound = "not_found"
+	// ReasonAccessDenied means PHP-FPM or the web server refused to serve the status path.
+	ReasonAccessDenied = "access_denied"
+	// ReasonParse means the status page couldn't be decoded.
+	ReasonParse = "parse"
+	// ReasonResponseTooLarge means the status page exceeded the maximum response size.
+	ReasonResponseTooLarge = "response_too_large"
+	// ReasonOther is any other error.
+	ReasonOther = "other"
+	// ReasonScrapeTimeout means the pool wasn't scraped at all because the scrape timeout was already over.
+	ReasonScrapeTimeout = "scrape_timeout"
+	// ReasonCircuitOpen means the scrape was skipped because the circuit breaker of the pool is open.
+	// Skipped scrapes aren't counted as failures.
+	ReasonCircuitOpen = "circuit_open"
+)
+
+// ScrapeError is a failed scrape of a pool classified by its reason.
+type ScrapeError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ScrapeError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorReason returns the reason of a failed scrape, one of the Reason constants.
+func ErrorReason(err error) string {
+	var scrapeErr *ScrapeError
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &scrapeErr):
+		return scrapeErr.Reason
+	case errors.Is(err, ErrResponseTooLarge):
+		return ReasonResponseTooLarge
+	case isTimeout(err):
+		return ReasonReadTimeout
+	}
+
+	return ReasonOther
+}
+
+// dialError classifies the error of a failed connect.
+func dialError(err error) error {
+	reason := ReasonOther
+
+	switch {
+	// A missing socket means PHP-FPM isn't running just like a refused connection.
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, os.ErrNotExist):
+		reason = ReasonDialRefused
+	case errors.Is(err, os.ErrPermission):
+		reason = ReasonPermissionDenied
+	case isTimeout(err):
+		reason = ReasonDialTimeout
+	}
+
+	return &ScrapeError{Reason: reason, Err: err}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
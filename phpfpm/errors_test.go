@@ -0,0 +1,147 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedAddress returns a TCP address nothing is listening on.
+func closedAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	return address
+}
+
+func TestErrorReason(t *testing.T) {
+	assert.Equal(t, "", ErrorReason(nil))
+	assert.Equal(t, ReasonOther, ErrorReason(errors.New("unexpected")))
+	assert.Equal(t, ReasonParse, ErrorReason(fmt.Errorf("scrape: %w", &ScrapeError{Reason: ReasonParse, Err: errors.New("invalid")})))
+	assert.Equal(t, ReasonResponseTooLarge, ErrorReason(fmt.Errorf("%w of 1 bytes", ErrResponseTooLarge)))
+	assert.Equal(t, ReasonReadTimeout, ErrorReason(os.ErrDeadlineExceeded))
+	assert.Equal(t, ReasonDialTimeout, ErrorReason(dialError(os.ErrDeadlineExceeded)))
+	assert.Equal(t, ReasonPermissionDenied, ErrorReason(dialError(&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EACCES)})))
+}
+
+func TestPoolUpdateErrorReason(t *testing.T) {
+	statusPage := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/status":
+			_, _ = w.Write([]byte(statusJSON))
+		case "/status.php":
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("Access denied.\n"))
+		case "/broken":
+			_, _ = w.Write([]byte(`{"pool":`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("File not found.\n"))
+		}
+	}))
+	hanging := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		time.Sleep(5 * time.Second)
+	})
+
+	tests := map[string]string{
+		"tcp://" + closedAddress(t) + "/status":                              ReasonDialRefused,
+		"unix://" + filepath.Join(t.TempDir(), "missing.sock") + ";/status":  ReasonDialRefused,
+		"tcp://" + hanging + "/status?timeout=50ms":                          ReasonReadTimeout,
+		"tcp://" + statusPage + "/fpm-status":                                ReasonNotFound,
+		"tcp://" + statusPage + "/status.php":                                ReasonAccessDenied,
+		"tcp://" + statusPage + "/broken":                                    ReasonParse,
+		"tcp://" + statusPage + "/status?max_response_size=100":              ReasonResponseTooLarge,
+		"tcp://" + statusPage + "/status?proxy=socks5://" + closedAddress(t): ReasonDialRefused,
+	}
+
+	for uri, reason := range tests {
+		p := Pool{Address: uri}
+		err := p.Update()
+		require.Error(t, err, uri)
+		assert.Equal(t, reason, ErrorReason(err), "%v: %v", uri, err)
+		assert.Equal(t, map[string]int64{reason: 1}, p.ScrapeErrors, uri)
+	}
+}
+
+func TestPoolUpdateErrorReasonPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can connect to any socket")
+	}
+
+	socket := filepath.Join(t.TempDir(), "php-fpm.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, os.Chmod(socket, 0))
+
+	p := Pool{Address: "unix://" + socket + ";/status"}
+	assert.Equal(t, ReasonPermissionDenied, ErrorReason(p.Update()))
+}
+
+func TestPoolUpdateErrorReasonHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fpm-status":
+			_, _ = w.Write([]byte(statusJSON))
+		case "/private":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	tests := map[string]string{
+		srv.URL + "/status":                          ReasonNotFound,
+		srv.URL + "/private":                         ReasonAccessDenied,
+		"http://" + closedAddress(t) + "/fpm-status": ReasonDialRefused,
+	}
+
+	for uri, reason := range tests {
+		p := Pool{Address: uri}
+		assert.Equal(t, reason, ErrorReason(p.Update()), uri)
+	}
+}
+
+func TestExporterScrapeErrors(t *testing.T) {
+	address := closedAddress(t)
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status")
+	e := NewExporter(&pm)
+
+	expected := `
+# HELP phpfpm_scrape_errors_total The number of failures scraping from PHP-FPM by reason.
+# TYPE phpfpm_scrape_errors_total counter
+phpfpm_scrape_errors_total{pool="",reason="dial_refused",scrape_uri="tcp://` + address + `/status"} 2
+`
+	_ = testutil.CollectAndCount(e)
+	require.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(expected), "phpfpm_scrape_errors_total"))
+}
@@ -15,8 +15,14 @@
 package phpfpm
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -27,13 +33,50 @@ const (
 
 // Exporter configures and exposes PHP-FPM metrics to Prometheus.
 type Exporter struct {
+	// mutex orders the snapshots taken after updates and after changes of the pools.
 	mutex       sync.Mutex
-	PoolManager PoolManager
+	PoolManager *PoolManager
 
 	CountProcessState bool
 
+	// MaxSnapshotAge marks pools as stale if they haven't been scraped within this duration. Zero disables it.
+	MaxSnapshotAge time.Duration
+
+	// background is set once Run refreshes the pools, Collect serves the snapshot afterwards.
+	background atomic.Bool
+	snapshot   atomic.Pointer[PoolManager]
+
+	// descs describes the metrics for the static labels of the pools.
+	descs atomic.Pointer[metricDescs]
+}
+
+// NewExporter creates a new Exporter for a PoolManager and configures the necessary metrics.
+func NewExporter(pm *PoolManager) *Exporter {
+	e := &Exporter{
+		PoolManager: pm,
+
+		CountProcessState: false,
+	}
+
+	e.descs.Store(newMetricDescs(labelNames(pm.Pools)))
+
+	return e
+}
+
+// metricDescs holds the descriptions of all metrics for a set of static label names.
+type metricDescs struct {
+	labelNames []string
+
 	up                       *prometheus.Desc
 	scrapeFailues            *prometheus.Desc
+	scrapeErrors             *prometheus.Desc
+	reconnects               *prometheus.Desc
+	jsonRepairs              *prometheus.Desc
+	scrapePartial            *prometheus.Desc
+	skippedProcesses         *prometheus.Desc
+	lastScrape               *prometheus.Desc
+	stale                    *prometheus.Desc
+	circuitOpen              *prometheus.Desc
 	startSince               *prometheus.Desc
 	acceptedConnections      *prometheus.Desc
 	listenQueue              *prometheus.Desc
@@ -50,140 +93,468 @@ type Exporter struct {
 	processLastRequestCPU    *prometheus.Desc
 	processRequestDuration   *prometheus.Desc
 	processState             *prometheus.Desc
+	pmInfo                   *prometheus.Desc
+	pmMaxChildren            *prometheus.Desc
+	pmStartServers           *prometheus.Desc
+	pmMinSpareServers        *prometheus.Desc
+	pmMaxSpareServers        *prometheus.Desc
+	pmMaxRequests            *prometheus.Desc
+	discoveredTargets        *prometheus.Desc
 }
 
-// NewExporter creates a new Exporter for a PoolManager and configures the necessary metrics.
-func NewExporter(pm PoolManager) *Exporter {
-	return &Exporter{
-		PoolManager: pm,
+// The exporter's own labels of the metrics, static labels are appended to them. See reservedLabels.
+var (
+	poolLabelNames       = []string{"pool", "scrape_uri"}
+	processLabelNames    = []string{"pool", "child", "scrape_uri"}
+	stateLabelNames      = []string{"pool", "child", "state", "scrape_uri"}
+	pmLabelNames         = []string{"pool", "scrape_uri", "pm"}
+	reasonLabelNames     = []string{"pool", "scrape_uri", "reason"}
+	discoveredLabelNames = []string{"scrape_uri"}
+)
 
-		CountProcessState: false,
+// newMetricDescs describes all metrics with the given static labels in addition to the exporter's own labels.
+func newMetricDescs(labelNames []string) *metricDescs {
+	poolLabels := slices.Concat(poolLabelNames, labelNames)
+	processLabels := slices.Concat(processLabelNames, labelNames)
+	stateLabels := slices.Concat(stateLabelNames, labelNames)
+	pmLabels := slices.Concat(pmLabelNames, labelNames)
+	reasonLabels := slices.Concat(reasonLabelNames, labelNames)
+
+	return &metricDescs{
+		labelNames: labelNames,
 
 		up: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "up"),
 			"Could PHP-FPM be reached?",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		scrapeFailues: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "scrape_failures"),
 			"The number of failures scraping from PHP-FPM.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
+			nil),
+
+		scrapeErrors: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "scrape_errors_total"),
+			"The number of failures scraping from PHP-FPM by reason.",
+			reasonLabels,
+			nil),
+
+		reconnects: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "reconnects_total"),
+			"The number of times a persistent connection to PHP-FPM had to be re-established.",
+			poolLabels,
+			nil),
+
+		jsonRepairs: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "json_repairs_total"),
+			"The number of malformed strings in the JSON status page of PHP-FPM which had to be repaired.",
+			poolLabels,
+			nil),
+
+		scrapePartial: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "scrape_partial"),
+			"Whether processes of the last scrape of PHP-FPM were skipped because they couldn't be decoded.",
+			poolLabels,
+			nil),
+
+		skippedProcesses: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "skipped_processes"),
+			"The number of processes of the last scrape of PHP-FPM which couldn't be decoded.",
+			poolLabels,
+			nil),
+
+		lastScrape: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "last_scrape_timestamp_seconds"),
+			"The unix timestamp of the last scrape of PHP-FPM.",
+			poolLabels,
+			nil),
+
+		stale: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "scrape_stale"),
+			"Whether the last scrape of PHP-FPM is older than the maximum snapshot age.",
+			poolLabels,
+			nil),
+
+		circuitOpen: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "pool", "circuit_open"),
+			"Whether scrapes of the pool are skipped because its last scrapes failed.",
+			poolLabels,
 			nil),
 
 		startSince: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "start_since"),
 			"The number of seconds since FPM has started.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		acceptedConnections: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "accepted_connections"),
 			"The number of requests accepted by the pool.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		listenQueue: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "listen_queue"),
 			"The number of requests in the queue of pending connections.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		maxListenQueue: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "max_listen_queue"),
 			"The maximum number of requests in the queue of pending connections since FPM has started.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		listenQueueLength: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "listen_queue_length"),
 			"The size of the socket queue of pending connections.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		idleProcesses: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "idle_processes"),
 			"The number of idle processes.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		activeProcesses: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "active_processes"),
 			"The number of active processes.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		totalProcesses: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "total_processes"),
 			"The number of idle + active processes.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		maxActiveProcesses: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "max_active_processes"),
 			"The maximum number of active processes since FPM has started.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		maxChildrenReached: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "max_children_reached"),
 			"The number of times, the process limit has been reached, when pm tries to start more children (works only for pm 'dynamic' and 'ondemand').",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		slowRequests: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "slow_requests"),
 			"The number of requests that exceeded your 'request_slowlog_timeout' value.",
-			[]string{"pool", "scrape_uri"},
+			poolLabels,
 			nil),
 
 		processRequests: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "process_requests"),
 			"The number of requests the process has served.",
-			[]string{"pool", "child", "scrape_uri"},
+			processLabels,
 			nil),
 
 		processLastRequestMemory: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "process_last_request_memory"),
 			"The max amount of memory the last request consumed.",
-			[]string{"pool", "child", "scrape_uri"},
+			processLabels,
 			nil),
 
 		processLastRequestCPU: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "process_last_request_cpu"),
 			"The %cpu the last request consumed.",
-			[]string{"pool", "child", "scrape_uri"},
+			processLabels,
 			nil),
 
 		processRequestDuration: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "process_request_duration"),
 			"The duration in microseconds of the requests.",
-			[]string{"pool", "child", "scrape_uri"},
+			processLabels,
 			nil),
 
 		processState: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "process_state"),
 			"The state of the process (Idle, Running, ...).",
-			[]string{"pool", "child", "state", "scrape_uri"},
+			stateLabels,
+			nil),
+
+		discoveredTargets: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "discovered_targets"),
+			"The number of sockets matching the glob pattern of the scrape URI.",
+			discoveredLabelNames,
+			nil),
+
+		pmInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_info"),
+			"The process manager configured in php-fpm.conf.",
+			pmLabels,
+			nil),
+
+		pmMaxChildren: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_max_children"),
+			"The value of pm.max_children configured in php-fpm.conf.",
+			poolLabels,
+			nil),
+
+		pmStartServers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_start_servers"),
+			"The value of pm.start_servers configured in php-fpm.conf.",
+			poolLabels,
+			nil),
+
+		pmMinSpareServers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_min_spare_servers"),
+			"The value of pm.min_spare_servers configured in php-fpm.conf.",
+			poolLabels,
+			nil),
+
+		pmMaxSpareServers: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_max_spare_servers"),
+			"The value of pm.max_spare_servers configured in php-fpm.conf.",
+			poolLabels,
+			nil),
+
+		pmMaxRequests: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "pm_max_requests"),
+			"The value of pm.max_requests configured in php-fpm.conf.",
+			poolLabels,
 			nil),
 	}
 }
 
+// labelNames returns the sorted names of all static labels of the pools.
+func labelNames(pools []Pool) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for idx := range pools {
+		for name := range pools[idx].Labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// labelValues returns the values of the static labels of the pool, empty if the pool doesn't have the label.
+func labelValues(pool *Pool, names []string) []string {
+	values := make([]string, len(names))
+	for idx, name := range names {
+		values[idx] = pool.Labels[name]
+	}
+	return values
+}
+
+// metricDescs returns the descriptions for the static labels of the pools. The pools are reloadable,
+// so the descriptions are only rebuilt if the set of label names changed.
+func (e *Exporter) metricDescs(pools []Pool) *metricDescs {
+	names := labelNames(pools)
+
+	if d := e.descs.Load(); d != nil && slices.Equal(d.labelNames, names) {
+		return d
+	}
+
+	d := newMetricDescs(names)
+	e.descs.Store(d)
+
+	return d
+}
+
+// scrapeTimeoutHeader is sent by Prometheus with the scrape timeout in seconds.
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// ScrapeContext returns a context of the request which is done once the scrape timeout of Prometheus minus offset has
+// passed, leaving time to send the metrics. Without the X-Prometheus-Scrape-Timeout-Seconds header only the request
+// itself limits the context.
+func ScrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get(scrapeTimeoutHeader), 64)
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// WithContext returns a collector for the exporter which aborts pending PHP-FPM scrapes once ctx is done,
+// e.g. when Prometheus gives up on the HTTP request.
+func (e *Exporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{exporter: e, ctx: ctx}
+}
+
 // Collect updates the Pools and sends the collected metrics to Prometheus
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext updates the Pools within the lifetime of ctx and sends the collected metrics to Prometheus.
+// If the pools are refreshed in the background the latest snapshot is sent instead.
+func (e *Exporter) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	if e.background.Load() {
+		if pm := e.snapshot.Load(); pm != nil {
+			e.collectPools(ch, pm)
+		}
+		return
+	}
+
+	if err := e.PoolManager.UpdateContext(ctx); err != nil {
+		log.Error(err)
+	}
+
+	e.collectPools(ch, e.PoolManager.snapshot())
+}
+
+// Refresh updates the Pools and stores a snapshot of the result.
+func (e *Exporter) Refresh(ctx context.Context) {
+	if err := e.PoolManager.UpdateContext(ctx); err != nil {
+		log.Error(err)
+	}
+
+	// Pools changed during the update are part of the snapshot, as it is taken afterwards.
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
-	if err := e.PoolManager.Update(); err != nil {
-		log.Error(err)
+	e.snapshot.Store(e.PoolManager.snapshot())
+}
+
+// Run refreshes the Pools every interval until ctx is done. While running, Collect no longer
+// scrapes PHP-FPM itself but serves the latest snapshot, regardless of how many Prometheus servers scrape.
+func (e *Exporter) Run(ctx context.Context, interval time.Duration) {
+	e.background.Store(true)
+	defer e.background.Store(false)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// A refresh must not take longer than the interval, otherwise the next one would be delayed.
+		refreshCtx, cancel := context.WithTimeout(ctx, interval)
+		e.Refresh(refreshCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	for _, pool := range e.PoolManager.Pools {
-		ch <- prometheus.MustNewConstMetric(e.scrapeFailues, prometheus.CounterValue, float64(pool.ScrapeFailures), pool.Name, pool.Address)
+// Sync replaces the pools of the PoolManager, see PoolManager.Sync.
+func (e *Exporter) Sync(next *PoolManager) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	added, removed := e.PoolManager.Sync(next)
+	log.Infof("Synced pools: %d added %v, %d removed %v", len(added), redactAddresses(added), len(removed), redactAddresses(removed))
+
+	e.storeSnapshot()
+}
+
+// AddPool adds a pool to the PoolManager, see PoolManager.AddConfig.
+func (e *Exporter) AddPool(pc PoolConfig) (PoolHandle, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	h, err := e.PoolManager.AddConfig(pc)
+	if err == nil {
+		e.storeSnapshot()
+	}
+
+	return h, err
+}
+
+// RemovePool removes a pool from the PoolManager, see PoolManager.Remove.
+func (e *Exporter) RemovePool(h PoolHandle) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	err := e.PoolManager.Remove(h)
+	if err == nil {
+		e.storeSnapshot()
+	}
+
+	return err
+}
+
+// storeSnapshot replaces the snapshot after pools have been added or removed, so Collect doesn't
+// have to wait for the next refresh to report the change. The mutex has to be held.
+func (e *Exporter) storeSnapshot() {
+	if e.background.Load() {
+		e.snapshot.Store(e.PoolManager.snapshot())
+	}
+}
+
+// Close closes all persistent connections to PHP-FPM.
+func (e *Exporter) Close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.PoolManager.Close()
+}
+
+func (e *Exporter) collectPools(ch chan<- prometheus.Metric, pm *PoolManager) {
+	now := time.Now()
+	d := e.metricDescs(pm.Pools)
+
+	for _, glob := range pm.Globs {
+		ch <- prometheus.MustNewConstMetric(d.discoveredTargets, prometheus.GaugeValue, float64(glob.Discovered), RedactAddress(glob.Template.Address))
+	}
+
+	for _, pool := range pm.Pools {
+		// Pools added by Sync are reported once they have been scraped.
+		if pool.LastScrape.IsZero() {
+			continue
+		}
+
+		scrapeURI := RedactAddress(pool.Address)
+		static := labelValues(&pool, d.labelNames)
+		poolLabels := append([]string{pool.Name, scrapeURI}, static...)
+
+		ch <- prometheus.MustNewConstMetric(d.scrapeFailues, prometheus.CounterValue, float64(pool.ScrapeFailures), poolLabels...)
+		for reason, count := range pool.ScrapeErrors {
+			ch <- prometheus.MustNewConstMetric(d.scrapeErrors, prometheus.CounterValue, float64(count), append([]string{pool.Name, scrapeURI, reason}, static...)...)
+		}
+		ch <- prometheus.MustNewConstMetric(d.reconnects, prometheus.CounterValue, float64(pool.Reconnects), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.jsonRepairs, prometheus.CounterValue, float64(pool.JSONRepairs), poolLabels...)
+
+		ch <- prometheus.MustNewConstMetric(d.lastScrape, prometheus.GaugeValue, float64(pool.LastScrape.UnixNano())/1e9, poolLabels...)
+
+		if c := pool.FPMConfig; c != nil {
+			ch <- prometheus.MustNewConstMetric(d.pmInfo, prometheus.GaugeValue, 1, append([]string{pool.Name, scrapeURI, c.ProcessManager}, static...)...)
+			ch <- prometheus.MustNewConstMetric(d.pmMaxChildren, prometheus.GaugeValue, float64(c.MaxChildren), poolLabels...)
+			ch <- prometheus.MustNewConstMetric(d.pmStartServers, prometheus.GaugeValue, float64(c.StartServers), poolLabels...)
+			ch <- prometheus.MustNewConstMetric(d.pmMinSpareServers, prometheus.GaugeValue, float64(c.MinSpareServers), poolLabels...)
+			ch <- prometheus.MustNewConstMetric(d.pmMaxSpareServers, prometheus.GaugeValue, float64(c.MaxSpareServers), poolLabels...)
+			ch <- prometheus.MustNewConstMetric(d.pmMaxRequests, prometheus.GaugeValue, float64(c.MaxRequests), poolLabels...)
+		}
+
+		ch <- prometheus.MustNewConstMetric(d.circuitOpen, prometheus.GaugeValue, boolToFloat64(pool.CircuitOpen()), poolLabels...)
+
+		stale := e.MaxSnapshotAge > 0 && now.Sub(pool.LastScrape) > e.MaxSnapshotAge
+		ch <- prometheus.MustNewConstMetric(d.stale, prometheus.GaugeValue, boolToFloat64(stale), poolLabels...)
+
+		if stale {
+			ch <- prometheus.MustNewConstMetric(d.up, prometheus.GaugeValue, 0, poolLabels...)
+			log.Errorf("Snapshot of PHP-FPM pool %v is stale, last scrape at %v", scrapeURI, pool.LastScrape)
+			continue
+		}
 
 		if pool.ScrapeError != nil {
-			ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0, pool.Name, pool.Address)
-			log.Errorf("Error scraping PHP-FPM: %v", pool.ScrapeError)
+			ch <- prometheus.MustNewConstMetric(d.up, prometheus.GaugeValue, 0, poolLabels...)
+			if ErrorReason(pool.ScrapeError) != ReasonCircuitOpen {
+				log.Errorf("Error scraping PHP-FPM: %v", pool.ScrapeError)
+			}
 			continue
 		}
 
@@ -198,21 +569,24 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 			total = pool.TotalProcesses
 		}
 
-		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 1, pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.startSince, prometheus.CounterValue, float64(pool.StartSince), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.acceptedConnections, prometheus.CounterValue, float64(pool.AcceptedConnections), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.listenQueue, prometheus.GaugeValue, float64(pool.ListenQueue), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.maxListenQueue, prometheus.CounterValue, float64(pool.MaxListenQueue), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.listenQueueLength, prometheus.GaugeValue, float64(pool.ListenQueueLength), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.idleProcesses, prometheus.GaugeValue, float64(idle), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.activeProcesses, prometheus.GaugeValue, float64(active), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.totalProcesses, prometheus.GaugeValue, float64(total), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.maxActiveProcesses, prometheus.CounterValue, float64(pool.MaxActiveProcesses), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.maxChildrenReached, prometheus.CounterValue, float64(pool.MaxChildrenReached), pool.Name, pool.Address)
-		ch <- prometheus.MustNewConstMetric(e.slowRequests, prometheus.CounterValue, float64(pool.SlowRequests), pool.Name, pool.Address)
+		ch <- prometheus.MustNewConstMetric(d.up, prometheus.GaugeValue, 1, poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.scrapePartial, prometheus.GaugeValue, boolToFloat64(pool.SkippedProcesses > 0), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.skippedProcesses, prometheus.GaugeValue, float64(pool.SkippedProcesses), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.startSince, prometheus.CounterValue, float64(pool.StartSince), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.acceptedConnections, prometheus.CounterValue, float64(pool.AcceptedConnections), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.listenQueue, prometheus.GaugeValue, float64(pool.ListenQueue), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.maxListenQueue, prometheus.CounterValue, float64(pool.MaxListenQueue), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.listenQueueLength, prometheus.GaugeValue, float64(pool.ListenQueueLength), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.idleProcesses, prometheus.GaugeValue, float64(idle), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.activeProcesses, prometheus.GaugeValue, float64(active), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.totalProcesses, prometheus.GaugeValue, float64(total), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.maxActiveProcesses, prometheus.CounterValue, float64(pool.MaxActiveProcesses), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.maxChildrenReached, prometheus.CounterValue, float64(pool.MaxChildrenReached), poolLabels...)
+		ch <- prometheus.MustNewConstMetric(d.slowRequests, prometheus.CounterValue, float64(pool.SlowRequests), poolLabels...)
 
 		for childNumber, process := range pool.Processes {
 			childName := fmt.Sprintf("%d", childNumber)
+			processLabels := append([]string{pool.Name, childName, scrapeURI}, static...)
 
 			states := map[string]int{
 				PoolProcessRequestIdle:           0,
@@ -225,33 +599,74 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 			states[process.State]++
 
 			for stateName, inState := range states {
-				ch <- prometheus.MustNewConstMetric(e.processState, prometheus.GaugeValue, float64(inState), pool.Name, childName, stateName, pool.Address)
+				ch <- prometheus.MustNewConstMetric(d.processState, prometheus.GaugeValue, float64(inState), append([]string{pool.Name, childName, stateName, scrapeURI}, static...)...)
 			}
-			ch <- prometheus.MustNewConstMetric(e.processRequests, prometheus.CounterValue, float64(process.Requests), pool.Name, childName, pool.Address)
-			ch <- prometheus.MustNewConstMetric(e.processLastRequestMemory, prometheus.GaugeValue, float64(process.LastRequestMemory), pool.Name, childName, pool.Address)
-			ch <- prometheus.MustNewConstMetric(e.processLastRequestCPU, prometheus.GaugeValue, process.LastRequestCPU, pool.Name, childName, pool.Address)
-			ch <- prometheus.MustNewConstMetric(e.processRequestDuration, prometheus.GaugeValue, float64(process.RequestDuration), pool.Name, childName, pool.Address)
+			ch <- prometheus.MustNewConstMetric(d.processRequests, prometheus.CounterValue, float64(process.Requests), processLabels...)
+			ch <- prometheus.MustNewConstMetric(d.processLastRequestMemory, prometheus.GaugeValue, float64(process.LastRequestMemory), processLabels...)
+			ch <- prometheus.MustNewConstMetric(d.processLastRequestCPU, prometheus.GaugeValue, process.LastRequestCPU, processLabels...)
+			ch <- prometheus.MustNewConstMetric(d.processRequestDuration, prometheus.GaugeValue, float64(process.RequestDuration), processLabels...)
 		}
 	}
 }
 
 // Describe exposes the metric description to Prometheus
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.up
-	ch <- e.startSince
-	ch <- e.acceptedConnections
-	ch <- e.listenQueue
-	ch <- e.maxListenQueue
-	ch <- e.listenQueueLength
-	ch <- e.idleProcesses
-	ch <- e.activeProcesses
-	ch <- e.totalProcesses
-	ch <- e.maxActiveProcesses
-	ch <- e.maxChildrenReached
-	ch <- e.slowRequests
-	ch <- e.processState
-	ch <- e.processRequests
-	ch <- e.processLastRequestMemory
-	ch <- e.processLastRequestCPU
-	ch <- e.processRequestDuration
+	d := e.descs.Load()
+
+	ch <- d.up
+	ch <- d.scrapeFailues
+	ch <- d.scrapeErrors
+	ch <- d.reconnects
+	ch <- d.jsonRepairs
+	ch <- d.scrapePartial
+	ch <- d.skippedProcesses
+	ch <- d.lastScrape
+	ch <- d.stale
+	ch <- d.circuitOpen
+	ch <- d.startSince
+	ch <- d.acceptedConnections
+	ch <- d.listenQueue
+	ch <- d.maxListenQueue
+	ch <- d.listenQueueLength
+	ch <- d.idleProcesses
+	ch <- d.activeProcesses
+	ch <- d.totalProcesses
+	ch <- d.maxActiveProcesses
+	ch <- d.maxChildrenReached
+	ch <- d.slowRequests
+	ch <- d.processState
+	ch <- d.pmInfo
+	ch <- d.pmMaxChildren
+	ch <- d.pmStartServers
+	ch <- d.pmMinSpareServers
+	ch <- d.pmMaxSpareServers
+	ch <- d.pmMaxRequests
+	ch <- d.discoveredTargets
+	ch <- d.processRequests
+	ch <- d.processLastRequestMemory
+	ch <- d.processLastRequestCPU
+	ch <- d.processRequestDuration
+}
+
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// contextCollector binds a context to the scrapes triggered by Collect.
+type contextCollector struct {
+	exporter *Exporter
+	ctx      context.Context
+}
+
+// Describe exposes the metric description to Prometheus
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
+}
+
+// Collect updates the Pools and sends the collected metrics to Prometheus
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.CollectContext(c.ctx, ch)
 }
@@ -0,0 +1,107 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporterRunServesSnapshot(t *testing.T) {
+	var scrapes atomic.Int64
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes.Add(1)
+		statusHandler(t).ServeHTTP(w, r)
+	}))
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status")
+	e := NewExporter(&pm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx, time.Hour)
+
+	require.Eventually(t, func() bool { return e.snapshot.Load() != nil }, time.Second, 10*time.Millisecond)
+
+	expected := fmt.Sprintf(`
+# HELP phpfpm_up Could PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up{pool="www",scrape_uri="tcp://%v/status"} 1
+`, address)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(expected), "phpfpm_up"))
+	}
+	assert.Equal(t, int64(1), scrapes.Load(), "collect doesn't scrape PHP-FPM")
+}
+
+func TestExporterStaleSnapshot(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status")
+	e := NewExporter(&pm)
+	e.MaxSnapshotAge = 50 * time.Millisecond
+	e.background.Store(true)
+
+	e.Refresh(context.Background())
+
+	assert.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(staleMetrics(address, 0, 1)), "phpfpm_up", "phpfpm_scrape_stale"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(staleMetrics(address, 1, 0)), "phpfpm_up", "phpfpm_scrape_stale"))
+}
+
+func staleMetrics(address string, stale int, up int) string {
+	return fmt.Sprintf(`
+# HELP phpfpm_scrape_stale Whether the last scrape of PHP-FPM is older than the maximum snapshot age.
+# TYPE phpfpm_scrape_stale gauge
+phpfpm_scrape_stale{pool="www",scrape_uri="tcp://%[1]v/status"} %[2]v
+# HELP phpfpm_up Could PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up{pool="www",scrape_uri="tcp://%[1]v/status"} %[3]v
+`, address, stale, up)
+}
+
+func TestScrapeContext(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	ctx, cancel := ScrapeContext(r, 500*time.Millisecond)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	assert.False(t, ok, "no deadline without the header")
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "2.5")
+	ctx, cancel = ScrapeContext(r, 500*time.Millisecond)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), deadline, 100*time.Millisecond)
+
+	ctx, cancel = ScrapeContext(r, 5*time.Second)
+	defer cancel()
+	deadline, ok = ctx.Deadline()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(2500*time.Millisecond), deadline, 100*time.Millisecond, "offset larger than the timeout is ignored")
+}
@@ -0,0 +1,423 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI protocol constants as defined in https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiVersion1 uint8 = 1
+
+	fcgiBeginRequest uint8 = 1
+	fcgiEndRequest   uint8 = 3
+	fcgiParams       uint8 = 4
+	fcgiStdin        uint8 = 5
+	fcgiStdout       uint8 = 6
+	fcgiStderr       uint8 = 7
+
+	fcgiResponder uint16 = 1
+
+	fcgiKeepConn uint8 = 1
+
+	fcgiRequestComplete uint8 = 0
+
+	fcgiMaxContentLen = 65535
+)
+
+// dialTimeout is the maximum amount of time a dial to PHP-FPM will wait for a connect to complete.
+const dialTimeout = 3 * time.Second
+
+// fcgiHeader is the fixed length header preceding every FastCGI record.
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fcgiResponse contains the result of a FastCGI request. The Body is received while it is read, Stderr, AppStatus
+// and ProtocolStatus are complete once the Body has been closed.
+type fcgiResponse struct {
+	// Header contains the CGI headers PHP-FPM sent in front of the body, e.g. Content-Type or Status.
+	Header http.Header
+	// Body streams stdout without the CGI headers. It has to be closed before the connection is used again.
+	Body io.ReadCloser
+	// Stderr contains everything PHP-FPM wrote to the FCGI_STDERR stream.
+	Stderr []byte
+	// AppStatus is the application-level status code of FCGI_END_REQUEST.
+	AppStatus uint32
+	// ProtocolStatus is the protocol-level status code of FCGI_END_REQUEST.
+	ProtocolStatus uint8
+}
+
+// fcgiConn is a FastCGI client connection to a PHP-FPM pool.
+type fcgiConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	requestID uint16
+}
+
+// dialFCGI connects to the FastCGI server at the given address, through the TCP proxy if set, and wraps the
+// connection in TLS if tlsConfig is set. The context is only used for the dial and the handshakes.
+func dialFCGI(ctx context.Context, network string, address string, proxy *url.URL, tlsConfig *tls.Config) (*fcgiConn, error) {
+	var conn net.Conn
+	var err error
+
+	if proxy != nil {
+		conn, err = dialProxy(ctx, proxy, address)
+	} else {
+		conn, err = dial(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+		}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return &fcgiConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// dial connects to address. Without a deadline on the context the dial is limited to dialTimeout.
+// Errors are classified as ScrapeError.
+func dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if _, ok := ctx.Deadline(); !ok {
+		dialer.Timeout = dialTimeout
+	}
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, dialError(err)
+	}
+
+	return conn, nil
+}
+
+// Close closes the underlying connection.
+func (c *fcgiConn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a FastCGI GET request with the given parameters and returns the response once the CGI headers have been
+// received. The body is streamed from the connection afterwards. The request is aborted as soon as the context is
+// done or stdout exceeds maxStdout bytes, unless it is zero.
+func (c *fcgiConn) Do(ctx context.Context, params map[string]string, keepConn bool, maxStdout int64) (*fcgiResponse, error) {
+	deadline, _ := ctx.Deadline()
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Unblock any pending read or write once the context is cancelled, until the body is closed.
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	stdout := &fcgiStdoutReader{c: c, resp: &fcgiResponse{}, ctx: ctx, deadline: deadline, stop: stop, maxStdout: maxStdout}
+	if err := c.do(stdout, params, keepConn); err != nil {
+		stop()
+		return nil, contextError(ctx, deadline, err)
+	}
+
+	return stdout.resp, nil
+}
+
+// contextError attributes an I/O error to the context if it is done, as the connection is unblocked via its deadline.
+func contextError(ctx context.Context, deadline time.Time, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+
+	// The connection deadline may pass slightly before the context reports it.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline) {
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+	}
+
+	return err
+}
+
+// do sends the request and receives the CGI headers.
+func (c *fcgiConn) do(stdout *fcgiStdoutReader, params map[string]string, keepConn bool) error {
+	c.requestID++
+	if c.requestID == 0 {
+		c.requestID = 1
+	}
+
+	var flags uint8
+	if keepConn {
+		flags = fcgiKeepConn
+	}
+
+	buf := &bytes.Buffer{}
+
+	begin := make([]byte, 8)
+	binary.BigEndian.PutUint16(begin, fcgiResponder)
+	begin[2] = flags
+	writeRecord(buf, fcgiBeginRequest, c.requestID, begin)
+	writeStream(buf, fcgiParams, c.requestID, encodeParams(params))
+	writeStream(buf, fcgiStdin, c.requestID, nil)
+
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		end, sep := headerEnd(stdout.buf)
+		if end < 0 && stdout.ended {
+			end, sep = len(stdout.buf), 0
+		}
+
+		if end >= 0 {
+			header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(stdout.buf[:end+sep]))).ReadMIMEHeader()
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("fastcgi: malformed CGI response headers: %v", err)
+			}
+
+			stdout.resp.Header = http.Header(header)
+			stdout.buf = stdout.buf[end+sep:]
+			stdout.resp.Body = stdout
+
+			return nil
+		}
+
+		if err := stdout.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// headerEnd returns the position of the blank line separating the CGI headers from the body and its length,
+// or -1 if stdout doesn't contain it yet.
+func headerEnd(stdout []byte) (end int, sep int) {
+	end, sep = bytes.Index(stdout, []byte("\r\n\r\n")), 4
+	if lf := bytes.Index(stdout, []byte("\n\n")); lf >= 0 && (end < 0 || lf < end) {
+		end, sep = lf, 2
+	}
+
+	return end, sep
+}
+
+// fcgiStdoutReader reads the records of a request and returns the content of its FCGI_STDOUT stream.
+type fcgiStdoutReader struct {
+	c         *fcgiConn
+	resp      *fcgiResponse
+	ctx       context.Context
+	deadline  time.Time
+	stop      func() bool
+	maxStdout int64
+
+	// received is the number of bytes of stdout received so far.
+	received int64
+	// buf is the content of stdout which hasn't been read yet.
+	buf   []byte
+	ended bool
+	err   error
+}
+
+func (s *fcgiStdoutReader) Read(b []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.ended {
+			return 0, io.EOF
+		}
+		s.err = s.next()
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
+
+// Close reads the remaining records of the request, so that the connection can be used for the next request.
+// It fails if the request couldn't be completed, in which case the connection must not be used again.
+func (s *fcgiStdoutReader) Close() error {
+	defer s.stop()
+
+	for s.err == nil && !s.ended {
+		s.buf = nil
+		s.err = s.next()
+	}
+
+	return s.err
+}
+
+// next reads the next record of the request.
+func (s *fcgiStdoutReader) next() error {
+	h, content, err := readRecord(s.c.r)
+	if err != nil {
+		return contextError(s.ctx, s.deadline, err)
+	}
+
+	// The spec says to ignore records of unknown requests.
+	if h.RequestID != s.c.requestID {
+		return nil
+	}
+
+	switch h.Type {
+	case fcgiStdout:
+		s.received += int64(len(content))
+		if s.maxStdout > 0 && s.received > s.maxStdout {
+			return fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, s.maxStdout)
+		}
+		s.buf = append(s.buf, content...)
+	case fcgiStderr:
+		s.resp.Stderr = append(s.resp.Stderr, content...)
+	case fcgiEndRequest:
+		if len(content) < 5 {
+			return fmt.Errorf("fastcgi: invalid end request record of length %d", len(content))
+		}
+		s.resp.AppStatus = binary.BigEndian.Uint32(content)
+		s.resp.ProtocolStatus = content[4]
+		s.ended = true
+
+		if s.resp.ProtocolStatus != fcgiRequestComplete {
+			return fmt.Errorf("fastcgi: request was rejected with protocol status %d", s.resp.ProtocolStatus)
+		}
+	default:
+		return fmt.Errorf("fastcgi: unexpected record type %d", h.Type)
+	}
+
+	return nil
+}
+
+// StatusCode returns the HTTP status code of the CGI Status header, which is 200 if PHP-FPM didn't send one.
+func (resp *fcgiResponse) StatusCode() int {
+	status := strings.TrimSpace(resp.Header.Get("Status"))
+	if status == "" {
+		return http.StatusOK
+	}
+
+	code, _, _ := strings.Cut(status, " ")
+	if n, err := strconv.Atoi(code); err == nil {
+		return n
+	}
+
+	return 0
+}
+
+// LastStderr returns the last non-empty line PHP-FPM wrote to stderr.
+func (resp *fcgiResponse) LastStderr() string {
+	stderr := bytes.TrimRight(resp.Stderr, " \t\r\n\x00")
+	if i := bytes.LastIndexAny(stderr, "\r\n"); i >= 0 {
+		stderr = stderr[i+1:]
+	}
+
+	return string(bytes.TrimSpace(stderr))
+}
+
+// writeRecord appends a single FastCGI record including padding to buf.
+func writeRecord(buf *bytes.Buffer, recType uint8, requestID uint16, content []byte) {
+	h := fcgiHeader{
+		Version:       fcgiVersion1,
+		Type:          recType,
+		RequestID:     requestID,
+		ContentLength: uint16(len(content)),
+		PaddingLength: uint8(-len(content) & 7),
+	}
+
+	_ = binary.Write(buf, binary.BigEndian, h)
+	buf.Write(content)
+	buf.Write(make([]byte, h.PaddingLength))
+}
+
+// writeStream splits content into records and terminates the stream with an empty record.
+func writeStream(buf *bytes.Buffer, recType uint8, requestID uint16, content []byte) {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxContentLen {
+			n = fcgiMaxContentLen
+		}
+		writeRecord(buf, recType, requestID, content[:n])
+		content = content[n:]
+	}
+	writeRecord(buf, recType, requestID, nil)
+}
+
+// readRecord reads a single FastCGI record and discards its padding.
+func readRecord(r io.Reader) (fcgiHeader, []byte, error) {
+	h := fcgiHeader{}
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return h, nil, err
+	}
+
+	if h.Version != fcgiVersion1 {
+		return h, nil, fmt.Errorf("fastcgi: unsupported protocol version %d", h.Version)
+	}
+
+	content := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if _, err := io.ReadFull(r, content); err != nil {
+		return h, nil, err
+	}
+
+	return h, content[:h.ContentLength], nil
+}
+
+// encodeParams encodes the parameters as FastCGI name-value pairs.
+func encodeParams(params map[string]string) []byte {
+	buf := &bytes.Buffer{}
+
+	for name, value := range params {
+		writeParamLength(buf, len(name))
+		writeParamLength(buf, len(value))
+		buf.WriteString(name)
+		buf.WriteString(value)
+	}
+
+	return buf.Bytes()
+}
+
+func writeParamLength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n)|1<<31)
+	buf.Write(b)
+}
@@ -0,0 +1,522 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const statusJSON = `{"pool":"www","process manager":"dynamic","start time":1528367006,"start since":15073840,"accepted conn":1577112,"listen queue":0,"max listen queue":0,"listen queue len":0,"idle processes":1,"active processes":1,"total processes":2,"max active processes":15,"max children reached":0,"slow requests":0,"processes":[{"pid":15873,"state":"Idle","start time":1543354120,"start since":86726,"requests":853,"request duration":5721,"request method":"GET","request uri":"/status?json&full","content length":0,"user":"-","script":"-","last request cpu":0.00,"last request memory":786432},{"pid":15874,"state":"Running","start time":1543354120,"start since":86726,"requests":854,"request duration":5721,"request method":"GET","request uri":"/index.php","content length":0,"user":"-","script":"/www/index.php","last request cpu":0.00,"last request memory":786432}]}`
+
+func init() {
+	SetLogger(logrus.New())
+}
+
+// listenFCGI starts a PHP-FPM stand-in serving handler via FastCGI and returns its address.
+func listenFCGI(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() { _ = fcgi.Serve(l, handler) }()
+
+	return l.Addr().String()
+}
+
+func statusHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "json&full", r.URL.RawQuery)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(statusJSON))
+	})
+}
+
+func TestFCGIConnDo(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Do(context.Background(), map[string]string{
+		"SCRIPT_NAME":     "/status",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_METHOD":  "GET",
+		"QUERY_STRING":    "json&full",
+	}, false, 0)
+
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, statusJSON, readBody(t, resp))
+	assert.Equal(t, uint32(0), resp.AppStatus)
+	assert.Empty(t, resp.Stderr)
+}
+
+// readBody reads and closes the body of the response.
+func readBody(t *testing.T, resp *fcgiResponse) string {
+	t.Helper()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	return string(body)
+}
+
+func TestFCGIConnDoLargeParams(t *testing.T) {
+	long := string(bytes.Repeat([]byte("a"), 70000))
+
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("X-Long")))
+	}))
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Do(context.Background(), map[string]string{
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_METHOD":  "GET",
+		"HTTP_X_LONG":     long,
+	}, false, 0)
+
+	require.NoError(t, err)
+	assert.Equal(t, long, readBody(t, resp))
+}
+
+func TestFCGIConnDoStderr(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		buf := &bytes.Buffer{}
+		writeStream(buf, fcgiStdout, requestID, []byte("Status: 404 Not Found\r\nContent-type: text/html\r\n\r\nFile not found.\n"))
+		writeStream(buf, fcgiStderr, requestID, []byte("Primary script unknown"))
+		writeRecord(buf, fcgiEndRequest, requestID, []byte{0, 0, 0, 1, fcgiRequestComplete, 0, 0, 0})
+		_, _ = conn.Write(buf.Bytes())
+	})
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Do(context.Background(), map[string]string{}, false, 0)
+
+	require.NoError(t, err)
+	assert.Equal(t, "404 Not Found", resp.Header.Get("Status"))
+	assert.Equal(t, "File not found.\n", readBody(t, resp))
+	assert.Equal(t, "Primary script unknown", string(resp.Stderr))
+	assert.Equal(t, uint32(1), resp.AppStatus)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+	assert.Equal(t, "Primary script unknown", resp.LastStderr())
+}
+
+func TestFCGIConnDoStreamsBody(t *testing.T) {
+	release := make(chan struct{})
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		buf := &bytes.Buffer{}
+		writeRecord(buf, fcgiStdout, requestID, []byte("Content-type: application/json\r\n\r\n{\"pool\":"))
+		_, _ = conn.Write(buf.Bytes())
+
+		<-release
+
+		buf.Reset()
+		writeStream(buf, fcgiStdout, requestID, []byte(`"www"}`))
+		writeStream(buf, fcgiStderr, requestID, []byte("done"))
+		writeRecord(buf, fcgiEndRequest, requestID, []byte{0, 0, 0, 7, fcgiRequestComplete, 0, 0, 0})
+		_, _ = conn.Write(buf.Bytes())
+	})
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Do(context.Background(), map[string]string{}, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"), "headers are returned before the body is complete")
+
+	head := make([]byte, 8)
+	_, err = io.ReadFull(resp.Body, head)
+	require.NoError(t, err)
+	assert.Equal(t, `{"pool":`, string(head))
+
+	close(release)
+
+	assert.Equal(t, `"www"}`, readBody(t, resp))
+	assert.Equal(t, "done", string(resp.Stderr))
+	assert.Equal(t, uint32(7), resp.AppStatus)
+}
+
+func TestFCGIConnDoMaxStdout(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		buf := &bytes.Buffer{}
+		writeRecord(buf, fcgiStdout, requestID, []byte("Content-type: application/json\r\n\r\n"))
+		writeRecord(buf, fcgiStdout, requestID, bytes.Repeat([]byte("x"), 100))
+		_, _ = conn.Write(buf.Bytes())
+	})
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	resp, err := c.Do(context.Background(), map[string]string{}, false, 100)
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.ErrorIs(t, resp.Body.Close(), ErrResponseTooLarge, "the connection can't be reused")
+}
+
+func TestFCGIResponseStatusCode(t *testing.T) {
+	tests := map[string]int{
+		"":                          http.StatusOK,
+		"200 OK":                    http.StatusOK,
+		"500 Internal Server Error": http.StatusInternalServerError,
+		"403":                       http.StatusForbidden,
+		"broken":                    0,
+	}
+
+	for status, code := range tests {
+		resp := fcgiResponse{Header: http.Header{}}
+		if status != "" {
+			resp.Header.Set("Status", status)
+		}
+		assert.Equal(t, code, resp.StatusCode(), status)
+	}
+}
+
+func TestFCGIResponseLastStderr(t *testing.T) {
+	resp := fcgiResponse{Stderr: []byte("PHP Warning:  first\nPHP Notice:  last \n\x00")}
+	assert.Equal(t, "PHP Notice:  last", resp.LastStderr())
+
+	resp = fcgiResponse{}
+	assert.Equal(t, "", resp.LastStderr())
+}
+
+func TestPoolUpdateStderr(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		buf := &bytes.Buffer{}
+		writeStream(buf, fcgiStdout, requestID, []byte("Status: 404 Not Found\r\nContent-type: text/html\r\n\r\nFile not found.\n"))
+		writeStream(buf, fcgiStderr, requestID, []byte("Primary script unknown"))
+		writeRecord(buf, fcgiEndRequest, requestID, []byte{0, 0, 0, 0, fcgiRequestComplete, 0, 0, 0})
+		_, _ = conn.Write(buf.Bytes())
+	})
+
+	p := Pool{Address: "tcp://" + address + "/fpm-status"}
+	err := p.Update()
+
+	assert.EqualError(t, err, `PHP-FPM responded to /fpm-status with status "404 Not Found": File not found. (stderr: Primary script unknown)`)
+	assert.Equal(t, ReasonNotFound, ErrorReason(err))
+	assert.Equal(t, "Primary script unknown", p.LastStderr)
+}
+
+func TestPoolUpdateServerError(t *testing.T) {
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Internal error\nwith details"))
+	}))
+
+	p := Pool{Address: "tcp://" + address + "/status"}
+	err := p.Update()
+
+	assert.EqualError(t, err, `PHP-FPM responded to /status with status "500 Internal Server Error": Internal error`)
+	assert.Equal(t, ReasonOther, ErrorReason(err))
+	assert.Empty(t, p.LastStderr)
+}
+
+func TestFCGIConnDoCancel(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		// Never respond to simulate a hung PHP-FPM.
+		time.Sleep(5 * time.Second)
+	})
+
+	c, err := dialFCGI(context.Background(), "tcp", address, nil, nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	started := time.Now()
+	_, err = c.Do(ctx, map[string]string{}, false, 0)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestPoolUpdate(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	p := Pool{Address: "tcp://" + address + "/status"}
+	err := p.Update()
+
+	require.NoError(t, err)
+	assert.Nil(t, p.ScrapeError)
+	assert.Equal(t, "www", p.Name)
+	assert.Equal(t, int64(1577112), p.AcceptedConnections)
+	assert.Len(t, p.Processes, 2)
+}
+
+func TestPoolUpdateAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract unix sockets are only supported on Linux")
+	}
+
+	name := fmt.Sprintf("@php-fpm_exporter-test-%d", os.Getpid())
+	listenUnixFCGI(t, name)
+
+	p := Pool{Address: "unix://" + name + ";/status?keepalive=true"}
+	defer p.Close()
+
+	require.NoError(t, p.Update())
+	require.NoError(t, p.Update())
+	assert.Equal(t, "www", p.Name)
+	assert.Len(t, p.Processes, 2)
+}
+
+func TestPoolUpdateDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	p := Pool{Address: "tcp://" + address + "/status"}
+	err = p.Update()
+
+	assert.Error(t, err)
+	assert.Equal(t, err, p.ScrapeError)
+	assert.Equal(t, int64(1), p.ScrapeFailures)
+}
+
+// listenRaw starts a FastCGI stand-in which reads a single request per connection and
+// hands the response over to respond.
+func listenRaw(t *testing.T, respond func(conn net.Conn, requestID uint16)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+				for {
+					h, _, err := readRecord(r)
+					if err != nil {
+						return
+					}
+					if h.Type == fcgiStdin {
+						respond(conn, h.RequestID)
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestEncodeParams(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 200))
+	encoded := encodeParams(map[string]string{"KEY": long})
+
+	assert.Equal(t, byte(3), encoded[0])
+	assert.Equal(t, uint32(200)|1<<31, binary.BigEndian.Uint32(encoded[1:5]))
+	assert.Equal(t, "KEY"+long, string(encoded[5:]))
+}
+
+// countingListener records the connections accepted by the wrapped listener.
+type countingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+func TestPoolUpdateKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	cl := &countingListener{Listener: l, conns: make(chan net.Conn, 10)}
+	go func() { _ = fcgi.Serve(cl, statusHandler(t)) }()
+
+	p := Pool{Address: "tcp://" + l.Addr().String() + "/status?keepalive=true"}
+	defer p.Close()
+
+	require.NoError(t, p.Update())
+	require.NoError(t, p.Update())
+	assert.Len(t, cl.conns, 1, "connection is reused")
+	assert.Equal(t, int64(0), p.Reconnects)
+
+	// Simulate PHP-FPM dropping the idle connection.
+	(<-cl.conns).Close()
+
+	require.NoError(t, p.Update())
+	assert.Len(t, cl.conns, 1, "connection is re-established")
+	assert.Equal(t, int64(1), p.Reconnects)
+	assert.Equal(t, int64(0), p.ScrapeFailures)
+}
+
+func TestPoolUpdateOptions(t *testing.T) {
+	var attempts int
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		assert.Equal(t, "json", r.URL.RawQuery)
+		if attempts < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status?retries=2&full=false&name=api&timeout=1s")
+
+	err := pm.Pools[0].Update()
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, "api", pm.Pools[0].Name)
+	assert.Equal(t, int64(0), pm.Pools[0].ScrapeFailures)
+}
+
+func TestPoolUpdateTimeout(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		time.Sleep(5 * time.Second)
+	})
+
+	p := Pool{Address: "tcp://" + address + "/status?timeout=50ms"}
+
+	started := time.Now()
+	err := p.Update()
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+// writeCertificate creates a self-signed certificate for 127.0.0.1 and php-fpm.internal which is valid for servers
+// and clients alike. It returns the certificate and the paths of the PEM encoded certificate and key.
+func writeCertificate(t *testing.T) (tls.Certificate, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "php-fpm.internal"},
+		DNSNames:              []string{"php-fpm.internal"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	return cert, certFile, keyFile
+}
+
+func TestPoolUpdateTCPS(t *testing.T) {
+	cert, certFile, keyFile := writeCertificate(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert.Leaf)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() { _ = fcgi.Serve(l, statusHandler(t)) }()
+
+	address := "tcps://" + l.Addr().String() + "/status"
+	client := "&cert_file=" + certFile + "&key_file=" + keyFile
+
+	p := Pool{Address: address + "?timeout=1s" + client}
+	assert.Error(t, p.Update(), "certificate of the server isn't trusted")
+
+	p = Pool{Address: address + "?ca_file=" + certFile}
+	assert.Error(t, p.Update(), "client certificate is required")
+
+	p = Pool{Address: address + "?ca_file=" + certFile + "&server_name=other.internal" + client}
+	assert.Error(t, p.Update(), "certificate doesn't match the server name")
+
+	p = Pool{Address: address + "?ca_file=" + certFile + "&server_name=php-fpm.internal&keepalive=true" + client}
+	defer p.Close()
+	require.NoError(t, p.Update())
+	require.NoError(t, p.Update())
+	assert.Equal(t, "www", p.Name)
+	assert.Len(t, p.Processes, 2)
+}
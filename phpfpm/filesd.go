@@ -0,0 +1,186 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// fileSDDebounce collects the events of a file being rewritten into a single change.
+const fileSDDebounce = 100 * time.Millisecond
+
+// TargetGroup is an entry of a Prometheus file_sd file, see
+// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#file_sd_config
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// ReadFileSD reads the pools of a Prometheus file_sd file. Files ending in .json are parsed as JSON,
+// everything else as YAML. Targets without a scheme, e.g. 127.0.0.1:9000, are scraped via tcp://<target>/status.
+// Labels starting with __ are dropped like Prometheus does after relabeling.
+// Like in Prometheus, a file which doesn't exist (yet) has no targets.
+func ReadFileSD(path string) ([]PoolConfig, error) {
+	content, err := os.ReadFile(path) // #nosec G304 -- the path is configured by the operator
+	if errors.Is(err, os.ErrNotExist) {
+		log.Infof("file_sd file %v doesn't exist, its targets are added once it is created", path)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []TargetGroup
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(content, &groups)
+	} else {
+		err = yaml.Unmarshal(content, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid file_sd file %v: %w", path, err)
+	}
+
+	var pools []PoolConfig
+	for idx, group := range groups {
+		labels := map[string]string{}
+		for name, value := range group.Labels {
+			if !strings.HasPrefix(name, "__") {
+				labels[name] = value
+			}
+		}
+
+		if err := validateLabels(labels); err != nil {
+			return nil, fmt.Errorf("%v: group %d: %w", path, idx, err)
+		}
+
+		for _, target := range group.Targets {
+			if !strings.Contains(target, "://") {
+				target = "tcp://" + target + "/status"
+			}
+
+			pools = append(pools, PoolConfig{Address: target, Labels: labels})
+		}
+	}
+
+	return pools, nil
+}
+
+// WatchFileSD calls onChange whenever one of the files is created, written, replaced or removed until ctx is done.
+// The directories of the files are watched, so files replaced by an atomic rename are picked up as well. Directories
+// which don't exist yet are watched for once their closest existing parent directory is.
+func WatchFileSD(ctx context.Context, paths []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watched := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		watched[path] = true
+		dirs[filepath.Dir(path)] = false
+	}
+
+	if err := watchDirs(watcher, dirs); err != nil {
+		return err
+	}
+
+	debounce := time.NewTimer(0)
+	<-debounce.C
+
+	for {
+		select {
+		case <-ctx.Done():
+			debounce.Stop()
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("file watcher closed")
+			}
+			if watched[event.Name] && !event.Has(fsnotify.Chmod) {
+				debounce.Reset(fileSDDebounce)
+			}
+			if event.Has(fsnotify.Create) && createsMissingDir(dirs, event.Name) {
+				if err := watchDirs(watcher, dirs); err != nil {
+					return err
+				}
+				// The file might have been written before its directory was watched.
+				debounce.Reset(fileSDDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("file watcher closed")
+			}
+			log.Errorf("Error watching file_sd files: %v", err)
+		case <-debounce.C:
+			onChange()
+		}
+	}
+}
+
+// watchDirs adds the directories which aren't watched yet to the watcher. A directory which doesn't exist
+// is marked as such and its closest existing parent is watched instead to notice when it is created.
+func watchDirs(watcher *fsnotify.Watcher, dirs map[string]bool) error {
+	for dir, ok := range dirs {
+		if ok {
+			continue
+		}
+
+		err := watcher.Add(dir)
+		if err == nil {
+			dirs[dir] = true
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to watch %v: %w", dir, err)
+		}
+
+		for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+			if err := watcher.Add(parent); err == nil {
+				break
+			} else if !errors.Is(err, os.ErrNotExist) || parent == filepath.Dir(parent) {
+				return fmt.Errorf("unable to watch %v: %w", dir, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// createsMissingDir reports whether the created path is one of the directories which don't exist yet or one of
+// their parents.
+func createsMissingDir(dirs map[string]bool, created string) bool {
+	for dir, ok := range dirs {
+		if !ok && (dir == created || strings.HasPrefix(dir, created+string(filepath.Separator))) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,140 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFileSD(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"targets.json": `[
+			{"targets": ["127.0.0.1:9000", "unix:///run/php/www.sock;/status"], "labels": {"env": "prod", "__meta_source": "x"}},
+			{"targets": ["tcp://10.0.0.1:9000/fpm-status?timeout=1s"]}
+		]`,
+		"targets.yml": `
+- targets:
+    - 127.0.0.1:9001
+  labels:
+    team: web
+`,
+		"invalid.yml": `
+- targets: [127.0.0.1:9000]
+  labels:
+    scrape_uri: x
+`,
+	})
+
+	pools, err := ReadFileSD(filepath.Join(dir, "targets.json"))
+	require.NoError(t, err)
+	assert.Equal(t, []PoolConfig{
+		{Address: "tcp://127.0.0.1:9000/status", Labels: map[string]string{"env": "prod"}},
+		{Address: "unix:///run/php/www.sock;/status", Labels: map[string]string{"env": "prod"}},
+		{Address: "tcp://10.0.0.1:9000/fpm-status?timeout=1s", Labels: map[string]string{}},
+	}, pools)
+
+	pools, err = ReadFileSD(filepath.Join(dir, "targets.yml"))
+	require.NoError(t, err)
+	assert.Equal(t, []PoolConfig{
+		{Address: "tcp://127.0.0.1:9001/status", Labels: map[string]string{"team": "web"}},
+	}, pools)
+
+	_, err = ReadFileSD(filepath.Join(dir, "invalid.yml"))
+	assert.EqualError(t, err, filepath.Join(dir, "invalid.yml")+": group 0: label 'scrape_uri' is reserved")
+
+	pools, err = ReadFileSD(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err, "missing files have no targets")
+	assert.Empty(t, pools)
+}
+
+func TestWatchFileSD(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"targets.json": `[]`, "other.json": `[]`})
+	path := filepath.Join(dir, "targets.json")
+
+	changes := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WatchFileSD(ctx, []string{path}, func() { changes <- struct{}{} })
+	}()
+
+	// Give the watcher time to start.
+	time.Sleep(50 * time.Millisecond)
+
+	// Other files in the directory are ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.json"), []byte(`[{}]`), 0o600))
+
+	// Replace the file atomically like most generators do.
+	tmp := filepath.Join(dir, ".targets.json.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte(`[{"targets": ["127.0.0.1:9000"]}]`), 0o600))
+	require.NoError(t, os.Rename(tmp, path))
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change was not detected")
+	}
+
+	time.Sleep(2 * fileSDDebounce)
+	assert.Empty(t, changes, "events are debounced")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWatchFileSDMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sd", "targets.json")
+
+	changes := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WatchFileSD(ctx, []string{path}, func() { changes <- struct{}{} })
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sd"), 0o755))
+	require.NoError(t, os.WriteFile(path, []byte(`[{"targets": ["127.0.0.1:9000"]}]`), 0o600))
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("creation was not detected")
+	}
+
+	// Changes are picked up once the directory is watched.
+	time.Sleep(2 * fileSDDebounce)
+	for len(changes) > 0 {
+		<-changes
+	}
+	require.NoError(t, os.WriteFile(path, []byte(`[]`), 0o600))
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change was not detected")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
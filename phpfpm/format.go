@@ -0,0 +1,316 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the PHP-FPM status page.
+const (
+	FormatJSON        = "json"
+	FormatOpenMetrics = "openmetrics"
+	FormatXML         = "xml"
+	FormatPlain       = "plain"
+)
+
+// plainTimeLayout is the format of start times on the plain text status page.
+const plainTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// statusStrings are the fields of the status page which are strings, all others are numbers.
+var statusStrings = map[string]bool{
+	"pool":            true,
+	"process manager": true,
+	"state":           true,
+	"request method":  true,
+	"request uri":     true,
+	"user":            true,
+	"script":          true,
+}
+
+// openMetricsFields maps the OpenMetrics samples of PHP 8.1+ to the fields of the status page.
+var openMetricsFields = map[string]string{
+	"phpfpm_start_since":          "start since",
+	"phpfpm_accepted_connections": "accepted conn",
+	"phpfpm_listen_queue":         "listen queue",
+	"phpfpm_max_listen_queue":     "max listen queue",
+	"phpfpm_listen_queue_length":  "listen queue len",
+	"phpfpm_idle_processes":       "idle processes",
+	"phpfpm_active_processes":     "active processes",
+	"phpfpm_total_processes":      "total processes",
+	"phpfpm_max_active_processes": "max active processes",
+	"phpfpm_max_children_reached": "max children reached",
+	"phpfpm_slow_requests":        "slow requests",
+}
+
+// openMetricsUpRE extracts pool name and process manager from the help of phpfpm_up.
+var openMetricsUpRE = regexp.MustCompile(`^# HELP phpfpm_up Could pool (\S+) using a (\S+) PM on PHP-FPM be reached\?`)
+
+// isFormat reports whether format is a known status page format.
+func isFormat(format string) bool {
+	switch format {
+	case FormatJSON, FormatOpenMetrics, FormatXML, FormatPlain:
+		return true
+	}
+	return false
+}
+
+// formatQuery returns the query string requesting the status page in the given format.
+// PHP-FPM doesn't support per process information in OpenMetrics.
+func formatQuery(format string, full bool) string {
+	var params []string
+
+	switch format {
+	case FormatOpenMetrics:
+		return FormatOpenMetrics
+	case FormatXML:
+		params = append(params, FormatXML)
+	case FormatPlain:
+	default:
+		params = append(params, FormatJSON)
+	}
+
+	if full {
+		params = append(params, "full")
+	}
+
+	return strings.Join(params, "&")
+}
+
+// isOpenMetrics reports whether the body is in the OpenMetrics format. PHP-FPM before 8.1 ignores the
+// openmetrics parameter and responds with the plain text format instead.
+func isOpenMetrics(body *statusBody) bool {
+	start, _ := body.Peek(512)
+	return bytes.HasPrefix(bytes.TrimSpace(start), []byte("#"))
+}
+
+// decodeStatus decodes the status page in the given format. Other formats than JSON are converted to the JSON
+// representation first, so that the quirks of the fields are handled in one place.
+// repairs is the number of malformed strings of a JSON status page, see decodeJSONStatus.
+func decodeStatus(format string, body io.Reader) (status *Status, repairs int, err error) {
+	var fields map[string]interface{}
+	var processes []map[string]interface{}
+
+	switch format {
+	case FormatOpenMetrics:
+		fields, err = parseOpenMetricsStatus(body)
+		processes = []map[string]interface{}{}
+	case FormatXML:
+		fields, processes, err = parseXMLStatus(body)
+	case FormatPlain:
+		fields, processes, err = parsePlainStatus(body)
+	default:
+		return decodeJSONStatus(body)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	status, err = decodeStatusFields(fields, processes)
+
+	return status, 0, err
+}
+
+// decodeStatusFields decodes the converted fields of the pool and its processes. Like decodeJSONStatus, processes are
+// decoded one by one and the ones which can't be decoded are skipped and counted in SkippedProcesses.
+func decodeStatusFields(fields map[string]interface{}, processes []map[string]interface{}) (*Status, error) {
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal(content, status); err != nil {
+		return nil, err
+	}
+
+	if processes == nil {
+		return status, nil
+	}
+
+	status.Processes = []PoolProcess{}
+	for _, fields := range processes {
+		var process PoolProcess
+		content, err := json.Marshal(fields)
+		if err == nil {
+			err = json.Unmarshal(content, &process)
+		}
+
+		if err != nil {
+			status.SkippedProcesses++
+			status.skipError = err
+			continue
+		}
+		status.Processes = append(status.Processes, process)
+	}
+
+	return status, nil
+}
+
+// statusValue converts a value of the status page to its JSON type.
+func statusValue(key string, value string) interface{} {
+	if statusStrings[key] {
+		return value
+	}
+
+	return json.Number(value)
+}
+
+// parsePlainStatus parses the default text format into the fields of the pool and of each process. Processes are
+// separated by a line of asterisks.
+func parsePlainStatus(body io.Reader) (map[string]interface{}, []map[string]interface{}, error) {
+	status := map[string]interface{}{}
+	processes := []map[string]interface{}{}
+	current := status
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "***") {
+			current = map[string]interface{}{}
+			processes = append(processes, current)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("expected key: value, got %v", line)
+		}
+
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		// An invalid start time is kept, so that only its process is skipped.
+		if key == "start time" {
+			if started, err := time.Parse(plainTimeLayout, value); err == nil {
+				value = strconv.FormatInt(started.Unix(), 10)
+			}
+		}
+
+		current[key] = statusValue(key, value)
+	}
+
+	return status, processes, scanner.Err()
+}
+
+// parseXMLStatus parses the XML format into the fields of the pool and of each process. Element names use dashes
+// instead of spaces.
+func parseXMLStatus(body io.Reader) (map[string]interface{}, []map[string]interface{}, error) {
+	decoder := xml.NewDecoder(body)
+
+	status := map[string]interface{}{}
+	processes := []map[string]interface{}{}
+	var current map[string]interface{}
+	var key string
+	var text strings.Builder
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "status", "processes":
+			case "process":
+				current = map[string]interface{}{}
+				processes = append(processes, current)
+			default:
+				key = strings.ReplaceAll(t.Name.Local, "-", " ")
+				text.Reset()
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "status", "processes":
+			case "process":
+				current = nil
+			default:
+				if current != nil {
+					current[key] = statusValue(key, text.String())
+				} else {
+					status[key] = statusValue(key, text.String())
+				}
+			}
+		}
+	}
+
+	return status, processes, nil
+}
+
+// parseOpenMetricsStatus parses the OpenMetrics format of PHP 8.1+. It only contains the pool, not its processes.
+// The start time is derived from the seconds since the start.
+func parseOpenMetricsStatus(body io.Reader) (map[string]interface{}, error) {
+	status := map[string]interface{}{}
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if match := openMetricsUpRE.FindStringSubmatch(line); match != nil {
+			status["pool"] = match[1]
+			status["process manager"] = match[2]
+			continue
+		}
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid sample %v", line)
+		}
+
+		name := strings.TrimSuffix(fields[0], "_total")
+		if idx := strings.IndexByte(name, '{'); idx >= 0 {
+			name = name[:idx]
+		}
+
+		if key, ok := openMetricsFields[name]; ok {
+			status[key] = statusValue(key, fields[1])
+		}
+	}
+
+	if since, ok := status["start since"].(json.Number); ok {
+		seconds, err := since.Int64()
+		if err != nil {
+			return nil, err
+		}
+		status["start time"] = time.Now().Add(-time.Duration(seconds) * time.Second).Unix()
+	}
+
+	return status, scanner.Err()
+}
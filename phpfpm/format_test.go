@@ -0,0 +1,235 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const statusPlain = `pool:                 www
+process manager:      dynamic
+start time:           07/Jun/2018:10:23:26 +0000
+start since:          15073840
+accepted conn:        1577112
+listen queue:         0
+max listen queue:     0
+listen queue len:     0
+idle processes:       1
+active processes:     1
+total processes:      2
+max active processes: 15
+max children reached: 0
+slow requests:        0
+
+************************
+pid:                  15873
+state:                Idle
+start time:           27/Nov/2018:21:28:40 +0000
+start since:          86726
+requests:             853
+request duration:     5721
+request method:       GET
+request URI:          /status?full
+content length:       0
+user:                 -
+script:               -
+last request cpu:     0.00
+last request memory:  786432
+
+************************
+pid:                  15874
+state:                Running
+start time:           27/Nov/2018:21:28:40 +0000
+start since:          86726
+requests:             854
+request duration:     5721
+request method:       GET
+request URI:          /index.php?q="quoted":1
+content length:       0
+user:                 -
+script:               /www/index.php
+last request cpu:     0.00
+last request memory:  786432
+`
+
+const statusXML = `<?xml version="1.0" ?>
+<status>
+<pool>www</pool>
+<process-manager>dynamic</process-manager>
+<start-time>1528367006</start-time>
+<start-since>15073840</start-since>
+<accepted-conn>1577112</accepted-conn>
+<listen-queue>0</listen-queue>
+<max-listen-queue>0</max-listen-queue>
+<listen-queue-len>0</listen-queue-len>
+<idle-processes>1</idle-processes>
+<active-processes>1</active-processes>
+<total-processes>2</total-processes>
+<max-active-processes>15</max-active-processes>
+<max-children-reached>0</max-children-reached>
+<slow-requests>0</slow-requests>
+<processes>
+<process><pid>15873</pid><state>Idle</state><start-time>1543354120</start-time><start-since>86726</start-since><requests>853</requests><request-duration>5721</request-duration><request-method>GET</request-method><request-uri>/status?xml&amp;full</request-uri><content-length>0</content-length><user>-</user><script>-</script><last-request-cpu>0.00</last-request-cpu><last-request-memory>786432</last-request-memory></process>
+<process><pid>15874</pid><state>Running</state><start-time>1543354120</start-time><start-since>86726</start-since><requests>854</requests><request-duration>5721</request-duration><request-method>GET</request-method><request-uri>/index.php?q=&quot;quoted&quot;</request-uri><content-length>0</content-length><user>-</user><script>/www/index.php</script><last-request-cpu>0.00</last-request-cpu><last-request-memory>786432</last-request-memory></process>
+</processes>
+</status>
+`
+
+const statusOpenMetrics = `# HELP phpfpm_up Could pool www using a dynamic PM on PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up 1
+# HELP phpfpm_start_since The number of seconds since FPM has started.
+# TYPE phpfpm_start_since counter
+phpfpm_start_since 15073840
+# HELP phpfpm_accepted_connections The number of requests accepted by the pool.
+# TYPE phpfpm_accepted_connections counter
+phpfpm_accepted_connections 1577112
+# HELP phpfpm_listen_queue The number of requests in the queue of pending connections.
+# TYPE phpfpm_listen_queue gauge
+phpfpm_listen_queue 0
+# HELP phpfpm_max_listen_queue The maximum number of requests in the queue of pending connections since FPM has started.
+# TYPE phpfpm_max_listen_queue counter
+phpfpm_max_listen_queue 0
+# TYPE phpfpm_listen_queue_length gauge
+phpfpm_listen_queue_length 0
+# TYPE phpfpm_idle_processes gauge
+phpfpm_idle_processes 1
+# TYPE phpfpm_active_processes gauge
+phpfpm_active_processes 1
+# TYPE phpfpm_total_processes gauge
+phpfpm_total_processes 2
+# TYPE phpfpm_max_active_processes counter
+phpfpm_max_active_processes 15
+# TYPE phpfpm_max_children_reached counter
+phpfpm_max_children_reached 0
+# TYPE phpfpm_slow_requests counter
+phpfpm_slow_requests 0
+# EOF
+`
+
+func TestFormatQuery(t *testing.T) {
+	assert.Equal(t, "json&full", formatQuery("", true))
+	assert.Equal(t, "json", formatQuery(FormatJSON, false))
+	assert.Equal(t, "xml&full", formatQuery(FormatXML, true))
+	assert.Equal(t, "full", formatQuery(FormatPlain, true))
+	assert.Equal(t, "", formatQuery(FormatPlain, false))
+	assert.Equal(t, "openmetrics", formatQuery(FormatOpenMetrics, true))
+}
+
+func TestPoolDecodeStatus(t *testing.T) {
+	for format, body := range map[string]string{FormatJSON: statusJSON, FormatPlain: statusPlain, FormatXML: statusXML} {
+		p, _, err := decodeStatus(format, strings.NewReader(body))
+		require.NoError(t, err, format)
+		assert.Equal(t, "www", p.Name, format)
+		assert.Equal(t, "dynamic", p.ProcessManager, format)
+		assert.Equal(t, int64(1528367006), time.Time(p.StartTime).Unix(), format)
+		assert.Equal(t, int64(1577112), p.AcceptedConnections, format)
+		assert.Equal(t, int64(15), p.MaxActiveProcesses, format)
+		require.Len(t, p.Processes, 2, format)
+		assert.Equal(t, int64(15874), p.Processes[1].PID, format)
+		assert.Equal(t, PoolProcessRequestRunning, p.Processes[1].State, format)
+		assert.Equal(t, int64(1543354120), p.Processes[1].StartTime, format)
+		assert.Equal(t, "/www/index.php", p.Processes[1].Script, format)
+		assert.Equal(t, int64(786432), p.Processes[1].LastRequestMemory, format)
+	}
+}
+
+func TestPoolDecodeStatusOpenMetrics(t *testing.T) {
+	p, _, err := decodeStatus(FormatOpenMetrics, strings.NewReader(statusOpenMetrics))
+	require.NoError(t, err)
+	assert.Equal(t, "www", p.Name)
+	assert.Equal(t, "dynamic", p.ProcessManager)
+	assert.Equal(t, int64(15073840), p.StartSince)
+	assert.InDelta(t, time.Now().Unix()-15073840, time.Time(p.StartTime).Unix(), 2)
+	assert.Equal(t, int64(1577112), p.AcceptedConnections)
+	assert.Equal(t, int64(2), p.TotalProcesses)
+	assert.Empty(t, p.Processes, "OpenMetrics doesn't contain processes")
+}
+
+func TestPoolDecodeStatusInvalid(t *testing.T) {
+	for format, body := range map[string]string{FormatPlain: "pool www", FormatXML: "<status><pool>www</status>"} {
+		_, _, err := decodeStatus(format, strings.NewReader(body))
+		assert.Error(t, err, format)
+	}
+
+	_, _, err := decodeStatus(FormatPlain, strings.NewReader("accepted conn: many"))
+	assert.Error(t, err)
+}
+
+func TestPoolDecodeStatusSkipsProcesses(t *testing.T) {
+	bodies := map[string]string{
+		FormatPlain: strings.Replace(statusPlain, "start time:           27/Nov/2018:21:28:40 +0000", "start time:           yesterday", 1),
+		FormatXML:   strings.Replace(statusXML, "<requests>853</requests>", "<requests>many</requests>", 1),
+	}
+
+	for format, body := range bodies {
+		p, _, err := decodeStatus(format, strings.NewReader(body))
+		require.NoError(t, err, format)
+		assert.Equal(t, "www", p.Name, format)
+		assert.Equal(t, int64(1577112), p.AcceptedConnections, format)
+		require.Len(t, p.Processes, 1, format)
+		assert.Equal(t, int64(15874), p.Processes[0].PID, format)
+		assert.Equal(t, int64(1), p.SkippedProcesses, format)
+		assert.Error(t, p.skipError, format)
+	}
+}
+
+func TestPoolUpdateFormat(t *testing.T) {
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.RawQuery {
+		case "xml":
+			_, _ = w.Write([]byte(statusXML))
+		case "openmetrics":
+			_, _ = w.Write([]byte(statusOpenMetrics))
+		default:
+			_, _ = w.Write([]byte(statusPlain))
+		}
+	}))
+
+	for _, format := range []string{FormatXML, FormatOpenMetrics, FormatPlain} {
+		p := Pool{Address: "tcp://" + address + "/status?full=false&format=" + format}
+
+		require.NoError(t, p.Update(), format)
+		assert.Equal(t, "www", p.Name, format)
+		assert.Equal(t, int64(1577112), p.AcceptedConnections, format)
+	}
+}
+
+func TestPoolUpdateOpenMetricsFallback(t *testing.T) {
+	var queries []string
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+
+		// PHP-FPM before 8.1 ignores unknown parameters.
+		if r.URL.Query().Has("json") {
+			_, _ = w.Write([]byte(statusJSON))
+			return
+		}
+		_, _ = w.Write([]byte(statusPlain))
+	}))
+
+	p := Pool{Address: "tcp://" + address + "/status?format=openmetrics"}
+
+	require.NoError(t, p.Update())
+	assert.Len(t, p.Processes, 2)
+	require.NoError(t, p.Update())
+
+	assert.Equal(t, []string{"openmetrics", "json&full", "json&full"}, queries)
+}
@@ -0,0 +1,278 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth protects against include loops in php-fpm.conf.
+const maxIncludeDepth = 10
+
+// DefaultFPMPrefix is the prefix PHP-FPM is installed to unless configured otherwise at build time,
+// e.g. in the official PHP docker images.
+const DefaultFPMPrefix = "/usr/local"
+
+var envVarRE = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// FPMPoolConfig holds the settings of a pool as configured in php-fpm.conf.
+type FPMPoolConfig struct {
+	Name string
+	// Listen is the address PHP-FPM accepts FastCGI requests on (`listen`).
+	Listen string
+	// StatusListen is the optional address dedicated to the status page (`pm.status_listen`).
+	StatusListen string
+	// StatusPath is the URI of the status page (`pm.status_path`).
+	StatusPath      string
+	ProcessManager  string
+	MaxChildren     int64
+	StartServers    int64
+	MinSpareServers int64
+	MaxSpareServers int64
+	MaxRequests     int64
+}
+
+// ParseFPMConfig parses php-fpm.conf and all files it includes and returns the configured pools in
+// the order they are defined. Like PHP-FPM, relative includes are resolved against the prefix PHP-FPM runs
+// with (-p), which defaults to DefaultFPMPrefix if empty.
+func ParseFPMConfig(path string, prefix string) ([]FPMPoolConfig, error) {
+	if prefix == "" {
+		prefix = DefaultFPMPrefix
+	}
+
+	p := &fpmConfigParser{
+		prefix: prefix,
+		pools:  map[string]*FPMPoolConfig{},
+	}
+
+	if err := p.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+
+	pools := make([]FPMPoolConfig, 0, len(p.order))
+	for _, name := range p.order {
+		pools = append(pools, *p.pools[name])
+	}
+
+	return pools, nil
+}
+
+type fpmConfigParser struct {
+	prefix  string
+	section string
+	pools   map[string]*FPMPoolConfig
+	order   []string
+}
+
+func (p *fpmConfigParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%v: includes are nested too deeply", path)
+	}
+
+	f, err := os.Open(path) // #nosec G304 -- the path is configured by the operator
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return fmt.Errorf("%v:%d: invalid section %v", path, lineNo, line)
+			}
+			p.section = strings.TrimSpace(line[1:end])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%v:%d: expected key = value, got %v", path, lineNo, line)
+		}
+
+		key = strings.TrimSpace(key)
+		value = p.expand(parseINIValue(value))
+
+		if key == "include" {
+			if err := p.include(value, depth); err != nil {
+				return fmt.Errorf("%v:%d: %w", path, lineNo, err)
+			}
+			continue
+		}
+
+		if err := p.set(key, value); err != nil {
+			return fmt.Errorf("%v:%d: %w", path, lineNo, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (p *fpmConfigParser) include(pattern string, depth int) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.prefix, pattern)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid include %v: %w", pattern, err)
+	}
+
+	for _, file := range files {
+		if err := p.parseFile(file, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expand substitutes $pool with the name of the current pool and ${VAR} with environment variables.
+func (p *fpmConfigParser) expand(value string) string {
+	value = strings.ReplaceAll(value, "$pool", p.section)
+
+	return envVarRE.ReplaceAllStringFunc(value, func(match string) string {
+		return os.Getenv(match[2 : len(match)-1])
+	})
+}
+
+func (p *fpmConfigParser) set(key string, value string) (err error) {
+	if p.section == "" || p.section == "global" {
+		return nil
+	}
+
+	pool, ok := p.pools[p.section]
+	if !ok {
+		pool = &FPMPoolConfig{Name: p.section}
+		p.pools[p.section] = pool
+		p.order = append(p.order, p.section)
+	}
+
+	switch key {
+	case "listen":
+		pool.Listen = value
+	case "pm.status_listen":
+		pool.StatusListen = value
+	case "pm.status_path":
+		pool.StatusPath = value
+	case "pm":
+		pool.ProcessManager = value
+	case "pm.max_children":
+		pool.MaxChildren, err = strconv.ParseInt(value, 10, 64)
+	case "pm.start_servers":
+		pool.StartServers, err = strconv.ParseInt(value, 10, 64)
+	case "pm.min_spare_servers":
+		pool.MinSpareServers, err = strconv.ParseInt(value, 10, 64)
+	case "pm.max_spare_servers":
+		pool.MaxSpareServers, err = strconv.ParseInt(value, 10, 64)
+	case "pm.max_requests":
+		pool.MaxRequests, err = strconv.ParseInt(value, 10, 64)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value '%v' for %v", value, key)
+	}
+
+	return nil
+}
+
+// parseINIValue removes quotes and trailing comments from an ini value.
+func parseINIValue(value string) string {
+	value = strings.TrimSpace(value)
+
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			return value[1 : end+1]
+		}
+	}
+
+	if idx := strings.IndexByte(value, ';'); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+
+	return value
+}
+
+// ScrapeURI returns the scrape URI for the status page of the pool.
+func (c FPMPoolConfig) ScrapeURI() (string, error) {
+	if c.StatusPath == "" {
+		return "", fmt.Errorf("pool %v has no pm.status_path", c.Name)
+	}
+
+	listen := c.Listen
+	if c.StatusListen != "" {
+		listen = c.StatusListen
+	}
+
+	if listen == "" {
+		return "", fmt.Errorf("pool %v has no listen address", c.Name)
+	}
+
+	if strings.HasPrefix(listen, "/") {
+		return fmt.Sprintf("unix://%v;%v", listen, c.StatusPath), nil
+	}
+
+	// A port only listens on all addresses.
+	if _, err := strconv.Atoi(listen); err == nil {
+		listen = "127.0.0.1:" + listen
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", fmt.Errorf("pool %v has an invalid listen address %v: %w", c.Name, listen, err)
+	}
+
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+
+	return fmt.Sprintf("tcp://%v%v", net.JoinHostPort(host, port), c.StatusPath), nil
+}
+
+// AddFPMConfig will add a pool to the pool manager based on its configuration in php-fpm.conf.
+func (pm *PoolManager) AddFPMConfig(c FPMPoolConfig) (PoolHandle, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	uri, err := c.ScrapeURI()
+	if err != nil {
+		return PoolHandle{}, err
+	}
+
+	p, err := pm.addConfig(PoolConfig{Address: uri, Name: c.Name})
+	if err != nil {
+		return PoolHandle{}, err
+	}
+
+	p.FPMConfig = &c
+
+	return PoolHandle{pm: pm, address: uri}, nil
+}
@@ -0,0 +1,154 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFiles creates the files relative to a temporary directory and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	return dir
+}
+
+func TestParseFPMConfig(t *testing.T) {
+	t.Setenv("FPM_STATUS_PATH", "/fpm-status")
+
+	dir := writeFiles(t, map[string]string{
+		"etc/php-fpm.conf": `
+; global options
+[global]
+pid = /run/php/php-fpm.pid
+include=etc/pool.d/*.conf
+`,
+		"etc/pool.d/www.conf": `
+[www]
+listen = /run/php/$pool.sock
+pm = dynamic
+pm.max_children = 5
+pm.start_servers = 2
+pm.min_spare_servers = 1
+pm.max_spare_servers = 3
+pm.max_requests = 500 ; recycle workers
+pm.status_path = "/status"
+`,
+		"etc/pool.d/api.conf": `
+[api]
+listen = 9001
+pm = ondemand
+pm.max_children = 10
+pm.status_listen = 127.0.0.1:9101
+pm.status_path = ${FPM_STATUS_PATH}
+`,
+		"etc/pool.d/nostatus.conf": `
+[nostatus]
+listen = [::]:9002
+pm = static
+`,
+	})
+
+	pools, err := ParseFPMConfig(filepath.Join(dir, "etc", "php-fpm.conf"), dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, []FPMPoolConfig{
+		{Name: "api", Listen: "9001", StatusListen: "127.0.0.1:9101", StatusPath: "/fpm-status", ProcessManager: "ondemand", MaxChildren: 10},
+		{Name: "nostatus", Listen: "[::]:9002", ProcessManager: "static"},
+		{Name: "www", Listen: "/run/php/www.sock", StatusPath: "/status", ProcessManager: "dynamic", MaxChildren: 5, StartServers: 2, MinSpareServers: 1, MaxSpareServers: 3, MaxRequests: 500},
+	}, pools)
+}
+
+func TestParseFPMConfigErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"invalid.conf": "[www]\npm.max_children = many\n",
+		"loop.conf":    "include = loop.conf\n",
+	})
+
+	_, err := ParseFPMConfig(filepath.Join(dir, "invalid.conf"), dir)
+	assert.EqualError(t, err, filepath.Join(dir, "invalid.conf")+":2: invalid value 'many' for pm.max_children")
+
+	_, err = ParseFPMConfig(filepath.Join(dir, "loop.conf"), dir)
+	assert.ErrorContains(t, err, "includes are nested too deeply")
+
+	_, err = ParseFPMConfig(filepath.Join(dir, "missing.conf"), dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFPMPoolConfigScrapeURI(t *testing.T) {
+	tests := []struct {
+		config   FPMPoolConfig
+		expected string
+		err      string
+	}{
+		{FPMPoolConfig{Listen: "/run/php/www.sock", StatusPath: "/status"}, "unix:///run/php/www.sock;/status", ""},
+		{FPMPoolConfig{Listen: "9000", StatusPath: "/status"}, "tcp://127.0.0.1:9000/status", ""},
+		{FPMPoolConfig{Listen: "0.0.0.0:9000", StatusPath: "/status"}, "tcp://127.0.0.1:9000/status", ""},
+		{FPMPoolConfig{Listen: "[::]:9000", StatusPath: "/status"}, "tcp://[::1]:9000/status", ""},
+		{FPMPoolConfig{Listen: "php:9000", StatusPath: "/status"}, "tcp://php:9000/status", ""},
+		{FPMPoolConfig{Listen: "9000", StatusListen: "/run/php/status.sock", StatusPath: "/status"}, "unix:///run/php/status.sock;/status", ""},
+		{FPMPoolConfig{Name: "www", Listen: "9000"}, "", "pool www has no pm.status_path"},
+		{FPMPoolConfig{Name: "www", StatusPath: "/status"}, "", "pool www has no listen address"},
+	}
+
+	for _, test := range tests {
+		uri, err := test.config.ScrapeURI()
+		if test.err != "" {
+			assert.EqualError(t, err, test.err)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, uri)
+	}
+}
+
+func TestExporterFPMConfig(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+	host, port, _ := strings.Cut(address, ":")
+	require.Equal(t, "127.0.0.1", host)
+
+	pm := PoolManager{}
+	_, err := pm.AddFPMConfig(FPMPoolConfig{Name: "www", Listen: port, StatusPath: "/status", ProcessManager: "dynamic", MaxChildren: 5, MaxRequests: 500})
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf(`
+# HELP phpfpm_pm_info The process manager configured in php-fpm.conf.
+# TYPE phpfpm_pm_info gauge
+phpfpm_pm_info{pm="dynamic",pool="www",scrape_uri="tcp://%[1]v/status"} 1
+# HELP phpfpm_pm_max_children The value of pm.max_children configured in php-fpm.conf.
+# TYPE phpfpm_pm_max_children gauge
+phpfpm_pm_max_children{pool="www",scrape_uri="tcp://%[1]v/status"} 5
+# HELP phpfpm_pm_max_requests The value of pm.max_requests configured in php-fpm.conf.
+# TYPE phpfpm_pm_max_requests gauge
+phpfpm_pm_max_requests{pool="www",scrape_uri="tcp://%[1]v/status"} 500
+`, address)
+
+	assert.NoError(t, testutil.CollectAndCompare(NewExporter(&pm), strings.NewReader(expected), "phpfpm_pm_info", "phpfpm_pm_max_children", "phpfpm_pm_max_requests"))
+}
@@ -0,0 +1,119 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GlobTarget is a scrape URI with a glob pattern in its socket path, e.g. unix:///run/php/*.sock;/status.
+// Every matching socket is scraped as a pool of its own.
+type GlobTarget struct {
+	// Template is copied for every matching socket. Its address contains the pattern.
+	Template Pool
+	// Discovered is the number of sockets matched by the last rescan.
+	Discovered int
+}
+
+// socketPattern returns the socket path of a unix scrape URI if it contains a glob pattern.
+// Abstract sockets aren't part of the filesystem and therefore never a pattern.
+func socketPattern(uri string) (string, bool) {
+	scheme, address, _, err := parseURL(uri)
+	if err != nil || scheme != "unix" || strings.HasPrefix(address, "@") || !strings.ContainsAny(address, "*?[") {
+		return "", false
+	}
+
+	return address, true
+}
+
+// expand returns a pool for every socket matching the pattern of the template.
+func (g *GlobTarget) expand() []Pool {
+	pattern, _ := socketPattern(g.Template.Address)
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Errorf("Invalid glob pattern in scrape URI %v: %v", RedactAddress(g.Template.Address), err)
+	}
+
+	pools := make([]Pool, 0, len(matches))
+	for _, match := range matches {
+		pools = append(pools, Pool{
+			Address:      strings.Replace(g.Template.Address, pattern, match, 1),
+			Options:      g.Template.Options,
+			Labels:       g.Template.Labels,
+			FPMConfig:    g.Template.FPMConfig,
+			DiscoveredBy: g.Template.Address,
+		})
+	}
+
+	g.Discovered = len(pools)
+
+	return pools
+}
+
+// Rescan expands the glob targets and runs the /proc discovery again. Pools for new sockets are added,
+// pools of vanished sockets are removed.
+func (pm *PoolManager) Rescan() (added []string, removed []string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.rescan()
+}
+
+func (pm *PoolManager) rescan() (added []string, removed []string) {
+	pools := make([]Pool, 0, len(pm.Pools))
+	for _, p := range pm.Pools {
+		if p.DiscoveredBy == "" {
+			pools = append(pools, p)
+		}
+	}
+
+	return pm.sync(pm.discover(pools))
+}
+
+// discover appends the pools of all glob targets and the /proc discovery to pools.
+// Sockets that are already scraped are skipped.
+func (pm *PoolManager) discover(pools []Pool) []Pool {
+	pm.lastRescan = time.Now()
+
+	known := map[string]bool{}
+	for _, p := range pools {
+		known[p.Address] = true
+	}
+
+	var discovered []Pool
+	for idx := range pm.Globs {
+		discovered = append(discovered, pm.Globs[idx].expand()...)
+	}
+
+	if pm.ProcDiscovery != nil {
+		discovered = append(discovered, pm.discoverProc()...)
+	}
+
+	for _, p := range discovered {
+		if !known[p.Address] {
+			known[p.Address] = true
+			pools = append(pools, p)
+		}
+	}
+
+	return pools
+}
+
+// rescanDue reports whether the pools should be discovered again before the next update.
+func (pm *PoolManager) rescanDue() bool {
+	return (len(pm.Globs) > 0 || pm.ProcDiscovery != nil) && time.Since(pm.lastRescan) >= pm.RescanInterval
+}
@@ -0,0 +1,150 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenUnixFCGI starts a PHP-FPM stand-in on a unix socket. Closing the listener removes the socket.
+func listenUnixFCGI(t *testing.T, path string) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() { _ = fcgi.Serve(l, statusHandler(t)) }()
+
+	return l
+}
+
+func TestSocketPattern(t *testing.T) {
+	pattern, ok := socketPattern("unix:///run/php/*.sock;/status?timeout=1s")
+	assert.True(t, ok)
+	assert.Equal(t, "/run/php/*.sock", pattern)
+
+	_, ok = socketPattern("unix:///run/php/www.sock;/status")
+	assert.False(t, ok)
+
+	_, ok = socketPattern("tcp://127.0.0.1:9000/status?name=*")
+	assert.False(t, ok)
+
+	_, ok = socketPattern("unix://@/run/php/*.sock;/status")
+	assert.False(t, ok)
+}
+
+func TestPoolManagerRescan(t *testing.T) {
+	dir := t.TempDir()
+	listenUnixFCGI(t, filepath.Join(dir, "a.sock"))
+	b := listenUnixFCGI(t, filepath.Join(dir, "b.sock"))
+
+	glob := "unix://" + dir + "/*.sock;/status"
+	pm := PoolManager{}
+	_, err := pm.AddConfig(PoolConfig{Address: glob, Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+	assert.Empty(t, pm.Pools)
+
+	require.NoError(t, pm.Update())
+	require.Len(t, pm.Pools, 2)
+	assert.Equal(t, "unix://"+dir+"/a.sock;/status", pm.Pools[0].Address)
+	assert.Equal(t, glob, pm.Pools[0].DiscoveredBy)
+	assert.Equal(t, map[string]string{"env": "prod"}, pm.Pools[0].Labels)
+	assert.Nil(t, pm.Pools[0].ScrapeError)
+	assert.Equal(t, 2, pm.Globs[0].Discovered)
+
+	b.Close()
+	listenUnixFCGI(t, filepath.Join(dir, "c.sock"))
+
+	added, removed := pm.Rescan()
+	assert.Equal(t, []string{"unix://" + dir + "/c.sock;/status"}, added)
+	assert.Equal(t, []string{"unix://" + dir + "/b.sock;/status"}, removed)
+	assert.Equal(t, 2, pm.Globs[0].Discovered)
+	assert.False(t, pm.Pools[0].LastScrape.IsZero(), "state of remaining pools is kept")
+}
+
+func TestPoolManagerRescanInterval(t *testing.T) {
+	dir := t.TempDir()
+	listenUnixFCGI(t, filepath.Join(dir, "a.sock"))
+
+	pm := PoolManager{RescanInterval: time.Hour}
+	pm.Add("unix://" + dir + "/*.sock;/status")
+
+	require.NoError(t, pm.Update())
+	assert.Len(t, pm.Pools, 1)
+
+	listenUnixFCGI(t, filepath.Join(dir, "b.sock"))
+
+	require.NoError(t, pm.Update())
+	assert.Len(t, pm.Pools, 1, "no rescan before the interval passed")
+}
+
+func TestPoolManagerRescanKeepsClientState(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("unix", filepath.Join(dir, "a.sock"))
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	var requests atomic.Int64
+	go func() {
+		_ = fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			// PHP-FPM before 8.1 ignores the request for OpenMetrics.
+			_, _ = w.Write([]byte(statusJSON))
+		}))
+	}()
+
+	pm := PoolManager{}
+	pm.Add("unix://" + dir + "/*.sock;/status?format=openmetrics")
+	defer pm.Close()
+
+	require.NoError(t, pm.Update())
+	assert.Equal(t, int64(2), requests.Load(), "the first update falls back to JSON")
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, pm.Update())
+		assert.Equal(t, int64(2+i), requests.Load(), "rescans keep what the client learned about the pool")
+	}
+	assert.Nil(t, pm.Pools[0].ScrapeError)
+}
+
+func TestExporterDiscoveredTargets(t *testing.T) {
+	dir := t.TempDir()
+	listenUnixFCGI(t, filepath.Join(dir, "a.sock"))
+
+	pm := PoolManager{}
+	pm.Add("unix://" + dir + "/*.sock;/status")
+	pm.Add("unix://" + dir + "/*.missing;/status")
+
+	expected := fmt.Sprintf(`
+# HELP phpfpm_discovered_targets The number of sockets matching the glob pattern of the scrape URI.
+# TYPE phpfpm_discovered_targets gauge
+phpfpm_discovered_targets{scrape_uri="unix://%[1]v/*.missing;/status"} 0
+phpfpm_discovered_targets{scrape_uri="unix://%[1]v/*.sock;/status"} 1
+`, dir)
+
+	assert.NoError(t, testutil.CollectAndCompare(NewExporter(&pm), strings.NewReader(expected), "phpfpm_discovered_targets"))
+}
@@ -0,0 +1,52 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import "errors"
+
+// ErrPoolNotFound is returned for handles of pools which are no longer managed.
+var ErrPoolNotFound = errors.New("pool not found")
+
+// ErrPoolExists is returned when adding an address which is already managed.
+var ErrPoolExists = errors.New("pool already exists")
+
+// PoolHandle refers to a pool or glob target of a PoolManager by its address. Unlike a copy of the Pool
+// it stays valid while pools are updated, added or removed and the configuration is reloaded.
+type PoolHandle struct {
+	pm      *PoolManager
+	address string
+}
+
+// Address returns the scrape URI of the pool.
+func (h PoolHandle) Address() string {
+	return h.address
+}
+
+// Pool returns a copy of the current state of the pool, or of the template for glob targets.
+// ok is false if the pool is no longer managed.
+func (h PoolHandle) Pool() (p Pool, ok bool) {
+	if h.pm == nil {
+		return Pool{}, false
+	}
+
+	h.pm.mutex.Lock()
+	defer h.pm.mutex.Unlock()
+
+	pool := h.pm.lookup(h.address)
+	if pool == nil {
+		return Pool{}, false
+	}
+
+	return *pool, true
+}
@@ -0,0 +1,149 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolManagerHandles(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	pm := PoolManager{}
+	h, err := pm.AddConfig(PoolConfig{Address: "tcp://" + address + "/status", Labels: map[string]string{"env": "prod"}})
+	require.NoError(t, err)
+	other := pm.Add("tcp://127.0.0.1:9001/status")
+
+	_, err = pm.AddConfig(PoolConfig{Address: "tcp://" + address + "/status"})
+	assert.ErrorIs(t, err, ErrPoolExists)
+
+	require.NoError(t, pm.Update())
+
+	p, ok := h.Pool()
+	require.True(t, ok)
+	assert.Equal(t, "www", p.Name, "handles see updates")
+	assert.Equal(t, map[string]string{"env": "prod"}, p.Labels)
+
+	require.NoError(t, pm.Remove(other))
+	_, ok = other.Pool()
+	assert.False(t, ok)
+	assert.ErrorIs(t, pm.Remove(other), ErrPoolNotFound)
+
+	p, ok = h.Pool()
+	require.True(t, ok, "handles stay valid when other pools are removed")
+	assert.Equal(t, "tcp://"+address+"/status", p.Address)
+
+	assert.Equal(t, []PoolHandle{h}, pm.List())
+
+	found, ok := pm.Handle("tcp://" + address + "/status")
+	assert.True(t, ok)
+	assert.Equal(t, h, found)
+}
+
+func TestPoolManagerRemoveGlob(t *testing.T) {
+	dir := t.TempDir()
+	listenUnixFCGI(t, filepath.Join(dir, "a.sock"))
+
+	pm := PoolManager{}
+	glob := pm.Add("unix://" + dir + "/*.sock;/status")
+	pm.Rescan()
+	require.Len(t, pm.Pools, 1)
+
+	discovered, _ := pm.Handle(pm.Pools[0].Address)
+	assert.ErrorContains(t, pm.Remove(discovered), "has been discovered by")
+
+	require.NoError(t, pm.Remove(glob))
+	assert.Empty(t, pm.Pools)
+	assert.Empty(t, pm.Globs)
+}
+
+func TestPoolManagerConcurrentUse(t *testing.T) {
+	address := listenFCGI(t, statusHandler(t))
+
+	pm := &PoolManager{}
+	e := NewExporter(pm)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = pm.Update()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			h, err := e.AddPool(PoolConfig{Address: fmt.Sprintf("tcp://%v/status?name=p%d", address, i)})
+			assert.NoError(t, err)
+			for _, h := range pm.List() {
+				h.Pool()
+			}
+			assert.NoError(t, e.RemovePool(h))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Empty(t, pm.List())
+}
+
+func TestPoolManagerUpdateDoesNotBlock(t *testing.T) {
+	scraping := make(chan struct{}, 2)
+	release := make(chan struct{})
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scraping <- struct{}{}
+		<-release
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	pm := &PoolManager{}
+	kept := pm.Add("tcp://" + address + "/status?name=kept")
+	removed := pm.Add("tcp://" + address + "/status?name=removed")
+
+	done := make(chan error)
+	go func() { done <- pm.Update() }()
+	<-scraping
+	<-scraping
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		assert.Len(t, pm.List(), 2)
+		assert.NoError(t, pm.Remove(removed))
+		_, err := pm.AddConfig(PoolConfig{Address: "tcp://127.0.0.1:9001/status"})
+		assert.NoError(t, err)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("pool management waited for the scrape")
+	}
+
+	close(release)
+	require.NoError(t, <-done)
+
+	p, ok := kept.Pool()
+	require.True(t, ok)
+	assert.Equal(t, "kept", p.Name, "results are merged by address")
+	assert.Len(t, pm.Pools, 2, "removed pools aren't added back")
+	_, ok = removed.Pool()
+	assert.False(t, ok)
+}
@@ -0,0 +1,205 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// userInfoRE matches the password of addresses which can't be parsed as URL.
+var userInfoRE = regexp.MustCompile(`(://[^/@:]*):[^/@]*@`)
+
+// isHTTPScheme reports whether the status page is scraped via HTTP instead of FastCGI,
+// e.g. through a status location of nginx.
+func isHTTPScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https" || scheme == "http+unix"
+}
+
+// requestHTTP requests the status page via HTTP and returns the body, which must be closed by the caller.
+// Credentials of the scrape URI are sent as basic auth.
+func (e *endpoint) requestHTTP(ctx context.Context, scheme string, address string, path string, query string) (io.ReadCloser, error) {
+	uri, err := url.Parse(e.target)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.client == nil {
+		if e.client, err = newHTTPClient(scheme, address, e.opts); err != nil {
+			return nil, err
+		}
+	}
+
+	target := url.URL{Scheme: scheme, Host: address, Path: path, RawQuery: query}
+	if scheme == "http+unix" {
+		// The host is irrelevant as the transport always dials the socket.
+		target.Scheme = "http"
+		target.Host = "localhost"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri.User != nil && uri.User.String() != "" {
+		password, _ := uri.User.Password()
+		req.SetBasicAuth(uri.User.Username(), password)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		err := fmt.Errorf("status page responded with HTTP status %v", resp.Status)
+
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return nil, &ScrapeError{Reason: ReasonNotFound, Err: err}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, &ScrapeError{Reason: ReasonAccessDenied, Err: err}
+		}
+		return nil, err
+	}
+
+	if max := e.opts.maxResponseSize(); resp.ContentLength > max {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, max)
+	}
+
+	return resp.Body, nil
+}
+
+// newHTTPClient creates the client used for all scrapes of a pool. Connections are only reused with Options.KeepAlive.
+func newHTTPClient(scheme string, address string, opts *PoolOptions) (*http.Client, error) {
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: !opts.KeepAlive,
+	}
+
+	proxy, err := opts.proxy()
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if scheme == "http+unix" {
+		transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			return dial(ctx, "unix", address)
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// tlsConfig returns the TLS configuration for https and tcps scrape URIs.
+func (opts PoolOptions) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: opts.ServerName, MinVersion: tls.VersionTLS12}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", opts.CAFile)
+		}
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// RedactAddress replaces the passwords of a scrape URI and its proxy option with "xxxxx" so that it can be logged,
+// returned by the API or used as label.
+func RedactAddress(address string) string {
+	uri, err := url.Parse(address)
+	if err != nil {
+		return userInfoRE.ReplaceAllString(address, "${1}:xxxxx@")
+	}
+
+	if _, ok := uri.User.Password(); ok {
+		redacted := strings.Replace(address, uri.User.String()+"@", uri.User.Username()+":xxxxx@", 1)
+		if redacted == address {
+			// The user info is escaped differently, fall back to the normalized URI.
+			redacted = uri.Redacted()
+		}
+		address = redacted
+	}
+
+	params := strings.Split(uri.RawQuery, "&")
+	for idx, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		if key != "proxy" {
+			continue
+		}
+
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+
+		if proxy, err := url.Parse(value); err == nil {
+			if _, ok := proxy.User.Password(); ok {
+				params[idx] = "proxy=" + proxy.Redacted()
+			}
+		}
+	}
+
+	if redacted := strings.Join(params, "&"); redacted != uri.RawQuery {
+		address = strings.Replace(address, "?"+uri.RawQuery, "?"+redacted, 1)
+	}
+
+	return address
+}
+
+// redactAddresses applies RedactAddress to all addresses.
+func redactAddresses(addresses []string) []string {
+	redacted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		redacted = append(redacted, RedactAddress(address))
+	}
+
+	return redacted
+}
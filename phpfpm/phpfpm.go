@@ -15,17 +15,16 @@
 package phpfpm
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	fcgiclient "github.com/tomasen/fcgi_client"
 )
 
 // PoolProcessRequestIdle defines a process that is idle.
@@ -58,32 +57,53 @@ type logger interface {
 	Errorf(string, ...interface{})
 }
 
-// PoolManager manages all configured Pools
+// PoolManager manages all configured Pools. Its methods are safe for concurrent use, Pools and Globs
+// must not be accessed directly while the PoolManager is shared between goroutines.
 type PoolManager struct {
 	Pools []Pool `json:"pools"`
+	// KeepAlive enables persistent FastCGI connections for pools added to the manager
+	// unless the scrape URI says otherwise.
+	KeepAlive bool `json:"-"`
+	// Globs are scrape URIs with a glob pattern in the socket path. The pools of the matching sockets are
+	// part of Pools and refreshed by Rescan.
+	Globs []GlobTarget `json:"-"`
+	// Client fetches the status pages of all Pools. It is created on the first update if it isn't set.
+	Client *Client `json:"-"`
+	// ProcDiscovery adds the pools of PHP-FPM master processes found in /proc on every Rescan if set.
+	ProcDiscovery *ProcDiscovery `json:"-"`
+	// RescanInterval is the minimum time between two rescans during updates. Zero rescans on every update.
+	RescanInterval time.Duration `json:"-"`
+	// MaxConcurrency limits the number of pools scraped at the same time. Zero scrapes all pools at once.
+	MaxConcurrency int `json:"-"`
+
+	mutex sync.Mutex
+	// updates serializes updates, so that the results of concurrent scrapes of a pool aren't lost.
+	updates    sync.Mutex
+	lastRescan time.Time
 }
 
 // Pool describes a single PHP-FPM pool that can be reached via a Socket or TCP address
 type Pool struct {
 	// The address of the pool, e.g. tcp://127.0.0.1:9000 or unix:///tmp/php-fpm.sock
-	Address             string        `json:"-"`
-	ScrapeError         error         `json:"-"`
-	ScrapeFailures      int64         `json:"-"`
-	Name                string        `json:"pool"`
-	ProcessManager      string        `json:"process manager"`
-	StartTime           timestamp     `json:"start time"`
-	StartSince          int64         `json:"start since"`
-	AcceptedConnections int64         `json:"accepted conn"`
-	ListenQueue         int64         `json:"listen queue"`
-	MaxListenQueue      int64         `json:"max listen queue"`
-	ListenQueueLength   int64         `json:"listen queue len"`
-	IdleProcesses       int64         `json:"idle processes"`
-	ActiveProcesses     int64         `json:"active processes"`
-	TotalProcesses      int64         `json:"total processes"`
-	MaxActiveProcesses  int64         `json:"max active processes"`
-	MaxChildrenReached  int64         `json:"max children reached"`
-	SlowRequests        int64         `json:"slow requests"`
-	Processes           []PoolProcess `json:"processes"`
+	Address             string            `json:"-"`
+	ScrapeError         error             `json:"-"`
+	ScrapeFailures      int64             `json:"-"`
+	ScrapeErrors        map[string]int64  `json:"-"`
+	Options             *PoolOptions      `json:"-"`
+	Labels              map[string]string `json:"-"`
+	Reconnects          int64             `json:"-"`
+	JSONRepairs         int64             `json:"-"`
+	LastStderr          string            `json:"last stderr,omitempty"`
+	ConsecutiveFailures int64             `json:"-"`
+	CircuitOpenUntil    time.Time         `json:"-"`
+	LastScrape          time.Time         `json:"-"`
+	FPMConfig           *FPMPoolConfig    `json:"-"`
+	DiscoveredBy        string            `json:"-"`
+	// Status is the status page of the last successful scrape. It is replaced as a whole by every scrape.
+	Status
+
+	// client fetches the status page. A Client of its own is created on the first update if it isn't set.
+	client *Client
 }
 
 type requestDuration int64
@@ -116,108 +136,445 @@ type PoolProcessStateCounter struct {
 }
 
 // Add will add a pool to the pool manager based on the given URI.
-func (pm *PoolManager) Add(uri string) Pool {
+// Invalid options in the URI are reported as scrape errors of the pool.
+func (pm *PoolManager) Add(uri string) PoolHandle {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
 	p := Pool{Address: uri}
+
+	defaults := DefaultPoolOptions
+	defaults.KeepAlive = pm.KeepAlive
+	if opts, err := ParsePoolOptions(uri, defaults); err == nil {
+		p.Options = &opts
+	}
+
+	pm.appendPool(p)
+	return PoolHandle{pm: pm, address: uri}
+}
+
+// Remove removes the pool and closes its connection. Removing a glob target removes all pools discovered by it.
+// Pools discovered by a glob target or in /proc can't be removed on their own.
+func (pm *PoolManager) Remove(h PoolHandle) error {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for idx := range pm.Globs {
+		if pm.Globs[idx].Template.Address != h.address {
+			continue
+		}
+
+		pm.Globs = append(pm.Globs[:idx], pm.Globs[idx+1:]...)
+
+		pools := make([]Pool, 0, len(pm.Pools))
+		for _, p := range pm.Pools {
+			if p.DiscoveredBy != h.address {
+				pools = append(pools, p)
+			}
+		}
+		pm.sync(pools)
+
+		return nil
+	}
+
+	idx := pm.index(h.address)
+	if idx < 0 {
+		return fmt.Errorf("%w: %v", ErrPoolNotFound, RedactAddress(h.address))
+	}
+
+	if by := pm.Pools[idx].DiscoveredBy; by != "" {
+		return fmt.Errorf("pool %v has been discovered by %v and can't be removed", RedactAddress(h.address), RedactAddress(by))
+	}
+
+	pm.Pools[idx].Close()
+	pm.Pools = append(pm.Pools[:idx], pm.Pools[idx+1:]...)
+
+	return nil
+}
+
+// List returns handles of all Pools followed by the ones of all Globs.
+func (pm *PoolManager) List() []PoolHandle {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	handles := make([]PoolHandle, 0, len(pm.Pools)+len(pm.Globs))
+	for _, p := range pm.Pools {
+		handles = append(handles, PoolHandle{pm: pm, address: p.Address})
+	}
+	for _, g := range pm.Globs {
+		handles = append(handles, PoolHandle{pm: pm, address: g.Template.Address})
+	}
+
+	return handles
+}
+
+// Handle returns the handle of the pool or glob target with the given address.
+func (pm *PoolManager) Handle(address string) (PoolHandle, bool) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return PoolHandle{pm: pm, address: address}, pm.lookup(address) != nil
+}
+
+// index returns the position of the pool in Pools or -1.
+func (pm *PoolManager) index(address string) int {
+	for idx := range pm.Pools {
+		if pm.Pools[idx].Address == address {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+// lookup returns the pool or the template of the glob target with the given address.
+func (pm *PoolManager) lookup(address string) *Pool {
+	if idx := pm.index(address); idx >= 0 {
+		return &pm.Pools[idx]
+	}
+
+	for idx := range pm.Globs {
+		if pm.Globs[idx].Template.Address == address {
+			return &pm.Globs[idx].Template
+		}
+	}
+
+	return nil
+}
+
+// appendPool adds the pool to Pools, or to Globs if its address contains a glob pattern, and returns a pointer to it.
+func (pm *PoolManager) appendPool(p Pool) *Pool {
+	if _, ok := socketPattern(p.Address); ok {
+		pm.Globs = append(pm.Globs, GlobTarget{Template: p})
+		return &pm.Globs[len(pm.Globs)-1].Template
+	}
+
 	pm.Pools = append(pm.Pools, p)
-	return p
+	return &pm.Pools[len(pm.Pools)-1]
+}
+
+// Sync replaces the Pools, Globs and ProcDiscovery with the ones of next. Pools with an address that is already known keep their
+// state, e.g. ScrapeFailures and persistent connections unless keepalive changed, but take over the new options, labels and php-fpm.conf settings.
+// Pools that are no longer present are closed.
+func (pm *PoolManager) Sync(next *PoolManager) (added []string, removed []string) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.Globs = next.Globs
+	pm.ProcDiscovery = next.ProcDiscovery
+
+	return pm.sync(pm.discover(append([]Pool(nil), next.Pools...)))
+}
+
+func (pm *PoolManager) sync(pools []Pool) (added []string, removed []string) {
+	existing := map[string]*Pool{}
+	for idx := range pm.Pools {
+		existing[pm.Pools[idx].Address] = &pm.Pools[idx]
+	}
+
+	synced := make([]Pool, 0, len(pools))
+	for _, p := range pools {
+		old, ok := existing[p.Address]
+		if !ok {
+			added = append(added, p.Address)
+			synced = append(synced, p)
+			continue
+		}
+
+		delete(existing, p.Address)
+
+		// The state the Client learned about the pool, e.g. whether it supports OpenMetrics, is kept. Its connections
+		// are only closed if keepalive changed, as they are set up for it.
+		if keepAlive(old.Options) != keepAlive(p.Options) {
+			old.Close()
+		}
+
+		old.Options = p.Options
+		old.Labels = p.Labels
+		old.FPMConfig = p.FPMConfig
+		synced = append(synced, *old)
+	}
+
+	for address, p := range existing {
+		p.Close()
+		removed = append(removed, address)
+	}
+
+	pm.Pools = synced
+
+	return added, removed
+}
+
+// keepAlive reports whether the options enable persistent connections. Pools without options use DefaultPoolOptions.
+func keepAlive(opts *PoolOptions) bool {
+	if opts == nil {
+		return DefaultPoolOptions.KeepAlive
+	}
+
+	return opts.KeepAlive
+}
+
+// snapshot returns a copy of all Pools and Globs which isn't affected by subsequent updates.
+// The processes don't need to be copied, as updates replace the Status of a pool instead of modifying it.
+func (pm *PoolManager) snapshot() *PoolManager {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return &PoolManager{Pools: append([]Pool(nil), pm.Pools...), Globs: append([]GlobTarget(nil), pm.Globs...), ProcDiscovery: pm.ProcDiscovery}
+}
+
+// Close closes the persistent connections of all Pools.
+func (pm *PoolManager) Close() {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for idx := range pm.Pools {
+		pm.Pools[idx].Close()
+	}
 }
 
 // Update will run the pool.Update() method concurrently on all Pools.
 func (pm *PoolManager) Update() (err error) {
+	return pm.UpdateContext(context.Background())
+}
+
+// UpdateContext will run the pool.UpdateContext() method concurrently on all Pools, at most MaxConcurrency at a time.
+// Pools are discovered again first if the RescanInterval has passed. Pending scrapes are aborted once the context is
+// done and pools which weren't scraped yet fail with ReasonScrapeTimeout.
+// The pools are scraped without holding the lock of the PoolManager, so its other methods don't wait for PHP-FPM.
+func (pm *PoolManager) UpdateContext(ctx context.Context) (err error) {
+	pm.updates.Lock()
+	defer pm.updates.Unlock()
+
+	pools, workers := pm.prepareUpdate()
+
+	if workers <= 0 || workers > len(pools) {
+		workers = len(pools)
+	}
+
+	scraped := make([]Pool, len(pools))
+	queue := make(chan int)
 	wg := &sync.WaitGroup{}
 
 	started := time.Now()
 
-	for idx := range pm.Pools {
+	var timedOut atomic.Int64
+
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(p *Pool) {
+		go func() {
 			defer wg.Done()
-			if err := p.Update(); err != nil {
-				log.Error(err)
+			for idx := range queue {
+				// Pools which are due once the scrape timeout is over aren't scraped at all.
+				if err := contextErr(ctx); err != nil {
+					scraped[idx] = pools[idx].timedOut(err)
+					timedOut.Add(1)
+					continue
+				}
+
+				var err error
+				scraped[idx], err = pools[idx].scrape(ctx)
+				if err != nil && ErrorReason(err) != ReasonCircuitOpen {
+					log.Error(err)
+				}
 			}
-		}(&pm.Pools[idx])
+		}()
 	}
 
+	for idx := range pools {
+		queue <- idx
+	}
+
+	close(queue)
 	wg.Wait()
 
 	ended := time.Now()
 
-	log.Debugf("Updated %v pool(s) in %v", len(pm.Pools), ended.Sub(started))
+	pm.merge(scraped)
+
+	if n := timedOut.Load(); n > 0 {
+		log.Errorf("%d of %d pool(s) not scraped within the scrape timeout", n, len(pools))
+	}
+
+	log.Debugf("Updated %v pool(s) in %v", len(pools), ended.Sub(started))
 
 	return nil
 }
 
+// prepareUpdate rescans the pools if due and returns copies of the Pools to scrape and the number of workers.
+func (pm *PoolManager) prepareUpdate() (pools []Pool, workers int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.rescanDue() {
+		if added, removed := pm.rescan(); len(added)+len(removed) > 0 {
+			log.Infof("Rescanned sockets: %d added %v, %d removed %v", len(added), redactAddresses(added), len(removed), redactAddresses(removed))
+		}
+	}
+
+	if pm.Client == nil {
+		pm.Client = &Client{KeepAlive: pm.KeepAlive}
+	}
+
+	pools = append([]Pool(nil), pm.Pools...)
+	for idx := range pools {
+		pools[idx].client = pm.Client
+	}
+
+	return pools, pm.MaxConcurrency
+}
+
+// merge swaps the scraped values of the pools into Pools. Options, labels and php-fpm.conf settings changed by Sync
+// during the scrape are kept. Pools which have been removed in the meantime are skipped.
+func (pm *PoolManager) merge(scraped []Pool) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for _, p := range scraped {
+		idx := pm.index(p.Address)
+		if idx < 0 {
+			// The connection might have been re-established by the scrape after the pool was closed.
+			p.Close()
+			continue
+		}
+
+		current := pm.Pools[idx]
+		p.Options = current.Options
+		p.Labels = current.Labels
+		p.FPMConfig = current.FPMConfig
+		p.DiscoveredBy = current.DiscoveredBy
+		pm.Pools[idx] = p
+	}
+}
+
 // Update will connect to PHP-FPM and retrieve the latest data for the pool.
 func (p *Pool) Update() (err error) {
-	p.ScrapeError = nil
+	return p.UpdateContext(context.Background())
+}
 
-	scheme, address, path, err := parseURL(p.Address)
-	if err != nil {
-		return p.error(err)
+// UpdateContext will connect to PHP-FPM and retrieve the latest data for the pool.
+// The scrape is aborted once the context is done.
+func (p *Pool) UpdateContext(ctx context.Context) (err error) {
+	next, err := p.scrape(ctx)
+	*p = next
+
+	if err != nil && ErrorReason(err) != ReasonCircuitOpen {
+		log.Error(err)
 	}
 
-	fcgi, err := fcgiclient.DialTimeout(scheme, address, time.Duration(3)*time.Second)
-	if err != nil {
-		return p.error(err)
+	return err
+}
+
+// scrape fetches the status page and returns a new value of the pool built from the result. p itself isn't modified,
+// so that readers of the pool don't race with the scrape.
+func (p *Pool) scrape(ctx context.Context) (Pool, error) {
+	next := *p
+	next.ScrapeError = nil
+	next.LastStderr = ""
+
+	if next.Options == nil {
+		opts, err := ParsePoolOptions(next.Address, DefaultPoolOptions)
+		if err != nil {
+			next.LastScrape = time.Now()
+			next.recordError(err)
+			return next, err
+		}
+		next.Options = &opts
 	}
 
-	defer fcgi.Close()
+	if next.CircuitOpen() {
+		// Known dead pools are neither scraped nor logged as errors until the cooldown has passed.
+		next.LastScrape = time.Now()
+		next.ScrapeError = next.circuitOpenError()
+		log.Debug(next.ScrapeError)
+		return next, next.ScrapeError
+	}
 
-	env := map[string]string{
-		"SCRIPT_FILENAME": path,
-		"SCRIPT_NAME":     path,
-		"SERVER_SOFTWARE": "go / php-fpm_exporter",
-		"REMOTE_ADDR":     "127.0.0.1",
-		"QUERY_STRING":    "json&full",
+	if next.client == nil {
+		next.client = &Client{}
 	}
 
-	resp, err := fcgi.Get(env)
-	if err != nil {
-		return p.error(err)
+	stats := fetchStats{}
+	status, err := next.client.fetch(ctx, next.Address, next.Options, &stats)
+
+	return next.withResult(status, stats, err), err
+}
+
+// withResult returns a new value of the pool with the status page and the stats of a scrape. The maps of the pool
+// are replaced instead of modified, so the pool itself isn't changed.
+func (p *Pool) withResult(status *Status, stats fetchStats, err error) Pool {
+	next := *p
+	next.LastScrape = time.Now()
+	next.LastStderr = stats.lastStderr
+	next.Reconnects += stats.reconnects
+	next.JSONRepairs += stats.jsonRepairs
+
+	if status != nil {
+		next.Status = *status
+	}
+
+	if next.Options.Name != "" {
+		next.Name = next.Options.Name
 	}
 
-	defer resp.Body.Close()
+	next.recordResult(err)
 
-	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return p.error(err)
+		next.recordError(err)
 	}
 
-	content = JSONResponseFixer(content)
+	return next
+}
 
-	log.Debugf("Pool[%v]: %v", p.Address, string(content))
+// Close closes the persistent connection of the pool, if any.
+func (p *Pool) Close() {
+	if p.client != nil {
+		p.client.CloseTarget(p.Address)
+	}
+}
 
-	if err = json.Unmarshal(content, &p); err != nil {
-		log.Errorf("Pool[%v]: %v", p.Address, string(content))
-		return p.error(err)
+// contextErr returns the error of ctx. A deadline which has passed counts even if ctx isn't done yet, as I/O deadlines
+// set from it might already have expired.
+func contextErr(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
 	}
 
-	return nil
+	return ctx.Err()
 }
 
-func (p *Pool) error(err error) error {
+// timedOut returns a new value of the pool marked as failed without scraping it, as the scrape timeout is already over.
+func (p *Pool) timedOut(err error) Pool {
+	next := *p
+	next.LastScrape = time.Now()
+	next.recordError(&ScrapeError{Reason: ReasonScrapeTimeout, Err: fmt.Errorf("pool %v not scraped within the scrape timeout: %w", RedactAddress(p.Address), err)})
+
+	return next
+}
+
+// recordError stores the error of a failed scrape and counts it.
+func (p *Pool) recordError(err error) {
 	p.ScrapeError = err
 	p.ScrapeFailures++
-	log.Error(err)
-	return err
+
+	// The map is replaced instead of modified, as copies of the pool share it.
+	byReason := make(map[string]int64, len(p.ScrapeErrors)+1)
+	for reason, count := range p.ScrapeErrors {
+		byReason[reason] = count
+	}
+	byReason[ErrorReason(err)]++
+	p.ScrapeErrors = byReason
 }
 
-// JSONResponseFixer resolves encoding issues with PHP-FPMs JSON response
+// JSONResponseFixer resolves encoding issues with PHP-FPMs JSON response. The content is returned unchanged
+// if it isn't complete.
 func JSONResponseFixer(content []byte) []byte {
-	c := string(content)
-	re := regexp.MustCompile(`(,"request uri":)"(.*?)"(,"content length":)`)
-	matches := re.FindAllStringSubmatch(c, -1)
-
-	for _, match := range matches {
-		requestURI, _ := json.Marshal(match[2])
-
-		sold := match[0]
-		snew := match[1] + string(requestURI) + match[3]
-
-		c = strings.ReplaceAll(c, sold, snew)
+	fixed, err := io.ReadAll(newJSONRepairReader(bytes.NewReader(content)))
+	if err != nil {
+		return content
 	}
 
-	return []byte(c)
+	return fixed
 }
 
 // CountProcessState return the calculated metrics based on the reported processes.
@@ -242,7 +599,8 @@ func CountProcessState(processes []PoolProcess) (active int64, idle int64, total
 	return active, idle, active + idle
 }
 
-// parseURL creates elements to be passed into fcgiclient.DialTimeout
+// parseURL creates elements to be passed into dialFCGI or requestHTTP. Like unix, http+unix separates the socket
+// from the status path with a semicolon. Linux abstract sockets start with @, e.g. unix://@php-fpm-api;/status.
 func parseURL(rawurl string) (scheme string, address string, path string, err error) {
 	uri, err := url.Parse(rawurl)
 	if err != nil {
@@ -252,8 +610,14 @@ func parseURL(rawurl string) (scheme string, address string, path string, err er
 	scheme = uri.Scheme
 
 	switch uri.Scheme {
-	case "unix":
-		result := strings.Split(uri.Path, ";")
+	case "unix", "http+unix":
+		socket := uri.Path
+		// url.Parse takes the @ of an abstract socket for empty user info and its name for the host.
+		if uri.User != nil && uri.User.String() == "" {
+			socket = "@" + uri.Host + uri.Path
+		}
+
+		result := strings.Split(socket, ";")
 		address = result[0]
 		if len(result) > 1 {
 			path = result[1]
@@ -14,10 +14,17 @@
 package phpfpm
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCountProcessState(t *testing.T) {
@@ -124,6 +131,11 @@ func TestParseURL(t *testing.T) {
 		{"tcp://127.0.0.1", []string{"tcp", "127.0.0.1", ""}, nil},
 		{"unix:///tmp/php.sock;/status", []string{"unix", "/tmp/php.sock", "/status"}, nil},
 		{"unix:///tmp/php.sock", []string{"unix", "/tmp/php.sock", ""}, nil},
+		{"https://127.0.0.1:8443/fpm-status", []string{"https", "127.0.0.1:8443", "/fpm-status"}, nil},
+		{"http+unix:///run/nginx.sock;/fpm-status", []string{"http+unix", "/run/nginx.sock", "/fpm-status"}, nil},
+		{"unix://@php-fpm-api;/status", []string{"unix", "@php-fpm-api", "/status"}, nil},
+		{"unix://@/run/php-fpm-api;/status", []string{"unix", "@/run/php-fpm-api", "/status"}, nil},
+		{"http+unix://@nginx;/fpm-status", []string{"http+unix", "@nginx", "/fpm-status"}, nil},
 	}
 
 	for _, u := range uris {
@@ -132,3 +144,118 @@ func TestParseURL(t *testing.T) {
 		assert.Equal(t, u.out, []string{scheme, address, path})
 	}
 }
+
+func TestParsePoolOptions(t *testing.T) {
+	var uris = []struct {
+		in  string
+		out PoolOptions
+		err bool
+	}{
+		{"tcp://127.0.0.1:9000/status", PoolOptions{Full: true}, false},
+		{"tcp://127.0.0.1:9000/status?timeout=5s&retries=2&name=api&full=false", PoolOptions{Name: "api", Timeout: 5 * time.Second, Retries: 2}, false},
+		{"unix:///tmp/php.sock;/status?keepalive=1", PoolOptions{Full: true, KeepAlive: true}, false},
+		{"tcp://127.0.0.1:9000/status?timeout=5", PoolOptions{}, true},
+		{"tcp://127.0.0.1:9000/status?retries=-1", PoolOptions{}, true},
+		{"tcp://127.0.0.1:9000/status?unknown=1", PoolOptions{}, true},
+		{"tcp://127.0.0.1:9000/status?format=xml", PoolOptions{Full: true, Format: FormatXML}, false},
+		{"tcp://127.0.0.1:9000/status?format=html", PoolOptions{}, true},
+		{"tcps://127.0.0.1:9000/status?ca_file=/ca.pem&server_name=fpm", PoolOptions{Full: true, CAFile: "/ca.pem", ServerName: "fpm"}, false},
+		{"tcps://127.0.0.1:9000/status?cert_file=/cert.pem", PoolOptions{}, true},
+		{"tcp://127.0.0.1:9000/status?max_response_size=1048576", PoolOptions{Full: true, MaxResponseSize: 1 << 20}, false},
+		{"tcp://127.0.0.1:9000/status?max_response_size=-1", PoolOptions{}, true},
+		{"tcp://127.0.0.1:9000/status?retries=3&backoff=250ms&breaker_threshold=5&breaker_cooldown=1m", PoolOptions{Full: true, Retries: 3, Backoff: 250 * time.Millisecond, BreakerThreshold: 5, BreakerCooldown: time.Minute}, false},
+		{"tcp://127.0.0.1:9000/status?breaker_threshold=-1", PoolOptions{}, true},
+	}
+
+	for _, u := range uris {
+		opts, err := ParsePoolOptions(u.in, DefaultPoolOptions)
+		if u.err {
+			assert.Error(t, err, u.in)
+			continue
+		}
+		assert.NoError(t, err, u.in)
+		assert.Equal(t, u.out, opts, u.in)
+	}
+}
+
+func TestParseURLIgnoresOptions(t *testing.T) {
+	scheme, address, path, err := parseURL("unix:///tmp/php.sock;/status?timeout=5s")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"unix", "/tmp/php.sock", "/status"}, []string{scheme, address, path})
+}
+
+func TestPoolManagerSync(t *testing.T) {
+	pm := PoolManager{}
+	pm.Add("tcp://127.0.0.1:9000/status")
+	pm.Add("tcp://127.0.0.1:9001/status")
+	pm.Pools[0].ScrapeFailures = 3
+	pm.Pools[1].ScrapeFailures = 5
+
+	next := PoolManager{}
+	_, _ = next.AddConfig(PoolConfig{Address: "tcp://127.0.0.1:9002/status"})
+	_, _ = next.AddConfig(PoolConfig{Address: "tcp://127.0.0.1:9000/status", Labels: map[string]string{"env": "prod"}})
+
+	added, removed := pm.Sync(&next)
+
+	assert.Equal(t, []string{"tcp://127.0.0.1:9002/status"}, added)
+	assert.Equal(t, []string{"tcp://127.0.0.1:9001/status"}, removed)
+	assert.Len(t, pm.Pools, 2)
+	assert.Equal(t, "tcp://127.0.0.1:9002/status", pm.Pools[0].Address)
+	assert.Equal(t, int64(0), pm.Pools[0].ScrapeFailures)
+	assert.Equal(t, "tcp://127.0.0.1:9000/status", pm.Pools[1].Address)
+	assert.Equal(t, int64(3), pm.Pools[1].ScrapeFailures, "state of unchanged pools is kept")
+	assert.Equal(t, map[string]string{"env": "prod"}, pm.Pools[1].Labels, "labels are updated")
+}
+
+func TestPoolManagerMaxConcurrency(t *testing.T) {
+	var running, peak atomic.Int64
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	pm := PoolManager{MaxConcurrency: 2}
+	for i := 0; i < 6; i++ {
+		pm.Add(fmt.Sprintf("tcp://%v/status?name=%d", address, i))
+	}
+
+	require.NoError(t, pm.Update())
+	assert.LessOrEqual(t, peak.Load(), int64(2))
+	for _, p := range pm.Pools {
+		assert.NoError(t, p.ScrapeError, p.Address)
+	}
+}
+
+func TestPoolManagerScrapeTimeout(t *testing.T) {
+	address := listenRaw(t, func(conn net.Conn, requestID uint16) {
+		time.Sleep(5 * time.Second)
+	})
+
+	pm := PoolManager{MaxConcurrency: 1}
+	for i := 0; i < 3; i++ {
+		pm.Add(fmt.Sprintf("tcp://%v/status?name=%d", address, i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	require.NoError(t, pm.UpdateContext(ctx))
+	assert.Less(t, time.Since(started), time.Second)
+
+	assert.Equal(t, ReasonReadTimeout, ErrorReason(pm.Pools[0].ScrapeError))
+	for _, p := range pm.Pools[1:] {
+		assert.Equal(t, ReasonScrapeTimeout, ErrorReason(p.ScrapeError), p.Address)
+		assert.Equal(t, map[string]int64{ReasonScrapeTimeout: 1}, p.ScrapeErrors, p.Address)
+		assert.False(t, p.LastScrape.IsZero(), p.Address)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prober scrapes a single pool per request, e.g. /probe?target=tcp://10.0.0.5:9000/status,
+// similar to the multi-target pattern of the blackbox exporter.
+type Prober struct {
+	// CountProcessState calculates the process numbers instead of using the ones reported by PHP-FPM.
+	CountProcessState bool
+	// TimeoutOffset is subtracted from the scrape timeout of Prometheus, see ScrapeContext.
+	TimeoutOffset time.Duration
+
+	allowed []*regexp.Regexp
+}
+
+// NewProber creates a Prober for targets matching one of the patterns. The patterns are regular expressions
+// which have to match the whole target. Without patterns every target is rejected, so the exporter can't be
+// abused as an open FastCGI proxy by accident.
+func NewProber(patterns []string) (*Prober, error) {
+	p := &Prober{}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe target pattern %v: %w", pattern, err)
+		}
+		p.allowed = append(p.allowed, re)
+	}
+
+	return p, nil
+}
+
+// Allowed reports whether the target may be probed.
+func (p *Prober) Allowed(target string) bool {
+	for _, re := range p.allowed {
+		if re.MatchString(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServeHTTP scrapes the target of the request and responds with the metrics of its pool.
+func (p *Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	if !p.Allowed(target) {
+		log.Infof("Rejected probe of target %v which is not allowed", RedactAddress(target))
+		http.Error(w, fmt.Sprintf("Target %v is not allowed", RedactAddress(target)), http.StatusForbidden)
+		return
+	}
+
+	pm := PoolManager{}
+	if _, err := pm.AddConfig(PoolConfig{Address: target}); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target %v: %v", RedactAddress(target), err), http.StatusBadRequest)
+		return
+	}
+
+	exporter := NewExporter(&pm)
+	exporter.CountProcessState = p.CountProcessState
+	defer exporter.Close()
+
+	ctx, cancel := ScrapeContext(r, p.TimeoutOffset)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter.WithContext(ctx))
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,317 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProcDiscoveredBy is the value of Pool.DiscoveredBy for pools found by ProcDiscovery.
+const ProcDiscoveredBy = "proc"
+
+var masterProcessRE = regexp.MustCompile(`^php-fpm[0-9.]*: master process`)
+
+// ProcDiscovery finds PHP-FPM master processes in /proc and derives scrape URIs from their listening sockets.
+// This requires running in the PID namespace of PHP-FPM and permission to read the file descriptors of the
+// master process, e.g. as the same user or with CAP_SYS_PTRACE.
+type ProcDiscovery struct {
+	// ProcRoot is the mount point of procfs.
+	ProcRoot string
+	// StatusPath is the pm.status_path of the discovered pools.
+	StatusPath string
+}
+
+// Discover returns the scrape URIs of all pools of all PHP-FPM master processes. Unix socket paths are
+// resolved via /proc/<pid>/root, so sockets in other mount namespaces, e.g. containers, are reachable.
+// TCP and abstract sockets are only reachable from the network namespace of the exporter, so they are
+// skipped for master processes in other network namespaces.
+func (d ProcDiscovery) Discover() ([]string, error) {
+	entries, err := os.ReadDir(d.ProcRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		if !d.isMaster(pid) {
+			continue
+		}
+
+		masterURIs, err := d.discoverMaster(pid)
+		if err != nil {
+			log.Debugf("Unable to discover pools of PHP-FPM master process %d: %v", pid, err)
+			continue
+		}
+
+		uris = append(uris, masterURIs...)
+	}
+
+	return uris, nil
+}
+
+func (d ProcDiscovery) path(pid int, elem ...string) string {
+	return filepath.Join(append([]string{d.ProcRoot, strconv.Itoa(pid)}, elem...)...)
+}
+
+// isMaster checks the process title PHP-FPM sets for its master process.
+func (d ProcDiscovery) isMaster(pid int) bool {
+	cmdline, err := os.ReadFile(d.path(pid, "cmdline"))
+	if err != nil {
+		return false
+	}
+
+	return masterProcessRE.Match(cmdline)
+}
+
+func (d ProcDiscovery) discoverMaster(pid int) ([]string, error) {
+	inodes, err := d.socketInodes(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+
+	sameNetNS := d.sameNetNS(pid)
+
+	sockets, err := d.listeningUnixSockets(pid)
+	if err != nil {
+		return nil, err
+	}
+	for inode, path := range sockets {
+		if !inodes[inode] {
+			continue
+		}
+		// Abstract sockets are bound to the network namespace instead of the filesystem of the process.
+		if !strings.HasPrefix(path, "@") {
+			path = d.path(pid, "root", path)
+		} else if !sameNetNS {
+			continue
+		}
+		uris = append(uris, fmt.Sprintf("unix://%v;%v", path, d.StatusPath))
+	}
+
+	if sameNetNS {
+		tcpURIs, err := d.tcpURIs(pid, inodes)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, tcpURIs...)
+	} else {
+		log.Debugf("PHP-FPM master process %d runs in another network namespace, skipping its TCP and abstract sockets", pid)
+	}
+
+	sort.Strings(uris)
+
+	return uris, nil
+}
+
+// tcpURIs returns the scrape URIs of the TCP sockets of the process which are listening.
+func (d ProcDiscovery) tcpURIs(pid int, inodes map[string]bool) ([]string, error) {
+	var uris []string
+
+	for _, file := range []string{"tcp", "tcp6"} {
+		addresses, err := d.listeningTCPSockets(pid, file)
+		if err != nil {
+			// tcp6 is missing if IPv6 is disabled.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for inode, address := range addresses {
+			if inodes[inode] {
+				uris = append(uris, fmt.Sprintf("tcp://%v%v", address, d.StatusPath))
+			}
+		}
+	}
+
+	return uris, nil
+}
+
+// sameNetNS reports whether the process runs in the network namespace of the exporter. Namespaces which
+// can't be compared, e.g. due to missing permissions, count as different.
+func (d ProcDiscovery) sameNetNS(pid int) bool {
+	own, err := os.Readlink(filepath.Join(d.ProcRoot, "self", "ns", "net"))
+	if err != nil {
+		return false
+	}
+
+	ns, err := os.Readlink(d.path(pid, "ns", "net"))
+
+	return err == nil && ns == own
+}
+
+// socketInodes returns the inodes of all sockets the process has open.
+func (d ProcDiscovery) socketInodes(pid int) (map[string]bool, error) {
+	fds, err := os.ReadDir(d.path(pid, "fd"))
+	if err != nil {
+		return nil, err
+	}
+
+	inodes := map[string]bool{}
+	for _, fd := range fds {
+		link, err := os.Readlink(d.path(pid, "fd", fd.Name()))
+		if err != nil {
+			continue
+		}
+
+		if inode, ok := strings.CutPrefix(link, "socket:["); ok {
+			inodes[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+
+	return inodes, nil
+}
+
+// listeningUnixSockets parses /proc/<pid>/net/unix and returns the paths of listening sockets by inode.
+//
+//	Num       RefCount Protocol Flags    Type St Inode Path
+//	0000000000000000: 00000002 00000000 00010000 0001 01 21857 /run/php/php-fpm.sock
+func (d ProcDiscovery) listeningUnixSockets(pid int) (map[string]string, error) {
+	const acceptConn = 0x10000
+
+	sockets := map[string]string{}
+	err := readProcTable(d.path(pid, "net", "unix"), func(fields []string) {
+		if len(fields) < 8 {
+			return
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&acceptConn == 0 {
+			return
+		}
+
+		sockets[fields[6]] = fields[7]
+	})
+
+	return sockets, err
+}
+
+// listeningTCPSockets parses /proc/<pid>/net/tcp or tcp6 and returns the addresses of listening sockets by inode.
+// Wildcard addresses are replaced by the loopback address.
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	0: 00000000:2328 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 21870
+func (d ProcDiscovery) listeningTCPSockets(pid int, file string) (map[string]string, error) {
+	const stateListen = "0A"
+
+	addresses := map[string]string{}
+	err := readProcTable(d.path(pid, "net", file), func(fields []string) {
+		if len(fields) < 10 || fields[3] != stateListen {
+			return
+		}
+
+		address, err := parseProcAddress(fields[1])
+		if err != nil {
+			log.Debugf("Invalid address %v in %v: %v", fields[1], file, err)
+			return
+		}
+
+		addresses[fields[9]] = address
+	})
+
+	return addresses, err
+}
+
+// readProcTable calls fn with the fields of every line of a /proc/net table except the header.
+func readProcTable(path string, fn func(fields []string)) error {
+	f, err := os.Open(path) // #nosec G304 -- path below the configured procfs mount
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for header := true; scanner.Scan(); header = false {
+		if !header {
+			fn(strings.Fields(scanner.Text()))
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseProcAddress parses an address like 0100007F:2328 of /proc/net/tcp{,6}. The IP consists of
+// 32 bit words in host byte order, which is little endian on all platforms PHP-FPM commonly runs on.
+func parseProcAddress(s string) (string, error) {
+	hexIP, hexPort, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", fmt.Errorf("missing port")
+	}
+
+	raw, err := hex.DecodeString(hexIP)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return "", fmt.Errorf("invalid ip %v", hexIP)
+	}
+
+	ip := make(net.IP, len(raw))
+	for word := 0; word < len(raw); word += 4 {
+		for idx := 0; idx < 4; idx++ {
+			ip[word+idx] = raw[word+3-idx]
+		}
+	}
+
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %v", hexPort)
+	}
+
+	switch {
+	case ip.Equal(net.IPv4zero):
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip.Equal(net.IPv6unspecified):
+		ip = net.IPv6loopback
+	}
+
+	// Return IPv4-mapped IPv6 addresses as IPv4.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10)), nil
+}
+
+// discoverProc creates the pools found by ProcDiscovery.
+func (pm *PoolManager) discoverProc() []Pool {
+	uris, err := pm.ProcDiscovery.Discover()
+	if err != nil {
+		log.Errorf("Unable to discover PHP-FPM in %v: %v", pm.ProcDiscovery.ProcRoot, err)
+		return nil
+	}
+
+	opts := DefaultPoolOptions
+	opts.KeepAlive = pm.KeepAlive
+
+	pools := make([]Pool, 0, len(uris))
+	for _, uri := range uris {
+		pools = append(pools, Pool{Address: uri, Options: &opts, DiscoveredBy: ProcDiscoveredBy})
+	}
+
+	return pools
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProc creates a procfs fixture with a PHP-FPM master (100) listening on a unix socket, an abstract
+// socket, 0.0.0.0:9000 and [::]:9001, one of its workers (101) and an unrelated process (200). The master
+// runs in the network namespace of the exporter.
+func fakeProc(t *testing.T) string {
+	t.Helper()
+
+	root := writeFiles(t, map[string]string{
+		"100/cmdline": "php-fpm: master process (/etc/php/8.2/fpm/php-fpm.conf)",
+		"100/net/unix": `Num       RefCount Protocol Flags    Type St Inode Path
+0000000000000000: 00000002 00000000 00010000 0001 01 1001 /run/php/www.sock
+0000000000000000: 00000002 00000000 00010000 0001 01 1002 @fpm-abstract
+0000000000000000: 00000002 00000000 00010000 0001 01 1003 /run/other.sock
+0000000000000000: 00000003 00000000 00000000 0001 03 1004 /run/php/www.sock
+`,
+		"100/net/tcp": `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:2328 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1005 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:2328 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1006 1 0000000000000000 100 0 0 10 0
+`,
+		"100/net/tcp6": `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:2329 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1007 1 0000000000000000 100 0 0 10 0
+`,
+		"100/root/.keep": "",
+		"101/cmdline":    "php-fpm: pool www",
+		"200/cmdline":    "nginx: master process /usr/sbin/nginx\x00",
+		"self/cmdline":   "",
+	})
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "100", "fd"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "100", "ns"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "self", "ns"), 0o755))
+	require.NoError(t, os.Symlink("net:[4026531840]", filepath.Join(root, "100", "ns", "net")))
+	require.NoError(t, os.Symlink("net:[4026531840]", filepath.Join(root, "self", "ns", "net")))
+
+	for fd, target := range map[string]string{"0": "/dev/null", "3": "socket:[1001]", "4": "socket:[1002]", "5": "socket:[1005]", "6": "socket:[1006]", "7": "socket:[1007]", "8": "socket:[1004]"} {
+		require.NoError(t, os.Symlink(target, filepath.Join(root, "100", "fd", fd)))
+	}
+
+	return root
+}
+
+func TestProcDiscovery(t *testing.T) {
+	root := fakeProc(t)
+
+	uris, err := ProcDiscovery{ProcRoot: root, StatusPath: "/status"}.Discover()
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"tcp://127.0.0.1:9000/status",
+		"tcp://[::1]:9001/status",
+		"unix://" + root + "/100/root/run/php/www.sock;/status",
+		"unix://@fpm-abstract;/status",
+	}, uris)
+
+	// Only sockets in the filesystem are reachable in another network namespace.
+	require.NoError(t, os.Remove(filepath.Join(root, "100", "ns", "net")))
+	require.NoError(t, os.Symlink("net:[4026532290]", filepath.Join(root, "100", "ns", "net")))
+
+	uris, err = ProcDiscovery{ProcRoot: root, StatusPath: "/status"}.Discover()
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unix://" + root + "/100/root/run/php/www.sock;/status"}, uris)
+}
+
+func TestParseProcAddress(t *testing.T) {
+	tests := map[string]string{
+		"0100007F:2328":                         "127.0.0.1:9000",
+		"0500000A:0050":                         "10.0.0.5:80",
+		"00000000:2328":                         "127.0.0.1:9000",
+		"00000000000000000000000001000000:2328": "[::1]:9000",
+		"0000000000000000FFFF00000500000A:2328": "10.0.0.5:9000",
+	}
+
+	for input, expected := range tests {
+		address, err := parseProcAddress(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, address, input)
+	}
+
+	_, err := parseProcAddress("0100007F")
+	assert.Error(t, err)
+}
+
+func TestPoolManagerProcDiscovery(t *testing.T) {
+	root := fakeProc(t)
+
+	pm := PoolManager{KeepAlive: true, ProcDiscovery: &ProcDiscovery{ProcRoot: root, StatusPath: "/fpm-status"}}
+	added, removed := pm.Rescan()
+
+	assert.Len(t, added, 4)
+	assert.Empty(t, removed)
+	assert.Equal(t, "tcp://127.0.0.1:9000/fpm-status", pm.Pools[0].Address)
+	assert.Equal(t, ProcDiscoveredBy, pm.Pools[0].DiscoveredBy)
+	assert.True(t, pm.Pools[0].Options.KeepAlive)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "100")))
+
+	added, removed = pm.Rescan()
+	assert.Empty(t, added)
+	assert.Len(t, removed, 4)
+	assert.Empty(t, pm.Pools)
+}
@@ -0,0 +1,297 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants as defined in RFC 1928 and RFC 1929.
+const (
+	socks5Version uint8 = 5
+
+	socks5AuthNone     uint8 = 0
+	socks5AuthPassword uint8 = 2
+	socks5AuthRejected uint8 = 0xff
+
+	socks5Connect uint8 = 1
+
+	socks5AddrIPv4   uint8 = 1
+	socks5AddrDomain uint8 = 3
+	socks5AddrIPv6   uint8 = 4
+
+	socks5PasswordVersion uint8 = 1
+)
+
+var socks5Replies = map[uint8]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// parseProxy parses the proxy URL of a scrape URI. Supported are socks5:// and http:// proxies, the latter via CONNECT.
+// Host names are always resolved by the proxy, so socks5h:// is accepted as well.
+func parseProxy(rawurl string) (*url.URL, error) {
+	proxy, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.Scheme != "socks5" && proxy.Scheme != "socks5h" && proxy.Scheme != "http" {
+		return nil, fmt.Errorf("proxy must start with socks5:// or http://")
+	}
+
+	if proxy.Port() == "" {
+		return nil, fmt.Errorf("proxy %v has no port", proxy.Redacted())
+	}
+
+	return proxy, nil
+}
+
+// dialProxy connects to the TCP address through the proxy. Without a deadline on the context the dial and
+// the handshake with the proxy are limited to dialTimeout.
+func dialProxy(ctx context.Context, proxy *url.URL, address string) (net.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+
+	conn, err := dial(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// Unblock the handshake once the context is cancelled.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	if proxy.Scheme == "http" {
+		conn, err = httpConnect(conn, proxy, address)
+	} else {
+		err = socks5Handshake(conn, proxy, address)
+	}
+
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %v: %w", proxy.Redacted(), err)
+	}
+
+	return conn, nil
+}
+
+// socks5Handshake asks the SOCKS5 proxy to connect to address. Host names are resolved by the proxy.
+func socks5Handshake(conn net.Conn, proxy *url.URL, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %v", portStr)
+	}
+
+	method := socks5AuthNone
+	if proxy.User != nil {
+		method = socks5AuthPassword
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := socks5Authenticate(conn, proxy.User); err != nil {
+			return err
+		}
+	case socks5AuthRejected:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %v is too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER, REP, RSV and ATYP are followed by the bound address and port.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0 {
+		if msg, ok := socks5Replies[header[1]]; ok {
+			return fmt.Errorf("connect to %v failed: %v", address, msg)
+		}
+		return fmt.Errorf("connect to %v failed with reply %d", address, header[1])
+	}
+
+	var bound int
+	switch header[3] {
+	case socks5AddrIPv4:
+		bound = net.IPv4len
+	case socks5AddrIPv6:
+		bound = net.IPv6len
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		bound = int(length[0])
+	default:
+		return fmt.Errorf("unsupported address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, bound+2))
+
+	return err
+}
+
+// socks5Authenticate runs the username/password authentication of RFC 1929.
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("username or password is too long")
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+
+	return nil
+}
+
+// httpConnect opens a tunnel to address via HTTP CONNECT. Credentials of the proxy URL are sent as basic auth.
+func httpConnect(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return conn, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT to %v failed with HTTP status %v", address, resp.Status)
+	}
+
+	// Nothing is expected before the first request is sent through the tunnel, but don't lose it if it is.
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn reads the data already buffered by the reader before the connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,115 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// DefaultBackoff is the delay before the first retry unless the scrape URI sets `backoff`.
+const DefaultBackoff = 100 * time.Millisecond
+
+// DefaultBreakerCooldown is the time scrapes are skipped once the circuit breaker opened unless the scrape URI
+// sets `breaker_cooldown`.
+const DefaultBreakerCooldown = 30 * time.Second
+
+// maxBackoff limits the delay between retries.
+const maxBackoff = 5 * time.Second
+
+// isTransient reports whether a failed scrape might succeed if it is retried right away. Misconfigurations like
+// a wrong status path fail the same way again.
+func isTransient(err error) bool {
+	switch ErrorReason(err) {
+	case ReasonDialRefused, ReasonDialTimeout, ReasonReadTimeout, ReasonOther:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the delay before the given retry. The delay doubles with every retry and is jittered
+// between half and the full delay, so that pools restarted together aren't retried in lockstep.
+func (opts PoolOptions) retryDelay(retry int) time.Duration {
+	delay := opts.Backoff
+	if delay == 0 {
+		delay = DefaultBackoff
+	}
+
+	for i := 1; i < retry && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// breakerCooldown returns BreakerCooldown or DefaultBreakerCooldown if it isn't set.
+func (opts PoolOptions) breakerCooldown() time.Duration {
+	if opts.BreakerCooldown == 0 {
+		return DefaultBreakerCooldown
+	}
+
+	return opts.BreakerCooldown
+}
+
+// wait blocks for the delay or until the context is done.
+func wait(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CircuitOpen reports whether scrapes of the pool are currently skipped by its circuit breaker.
+func (p *Pool) CircuitOpen() bool {
+	return time.Now().Before(p.CircuitOpenUntil)
+}
+
+// circuitOpenError is the error of scrapes skipped by the circuit breaker.
+func (p *Pool) circuitOpenError() error {
+	return &ScrapeError{
+		Reason: ReasonCircuitOpen,
+		Err:    fmt.Errorf("pool %v skipped until %v after %d failed scrapes", RedactAddress(p.Address), p.CircuitOpenUntil.Format(time.RFC3339), p.ConsecutiveFailures),
+	}
+}
+
+// recordResult updates the circuit breaker with the result of a scrape. The breaker opens once
+// Options.BreakerThreshold scrapes in a row failed. After the cooldown a single scrape is let through, which opens
+// the breaker again right away if it fails.
+func (p *Pool) recordResult(err error) {
+	if err == nil {
+		if p.Options.BreakerThreshold > 0 && p.ConsecutiveFailures >= int64(p.Options.BreakerThreshold) {
+			log.Infof("Pool[%v]: closing circuit breaker, scrape succeeded", RedactAddress(p.Address))
+		}
+		p.ConsecutiveFailures = 0
+		p.CircuitOpenUntil = time.Time{}
+		return
+	}
+
+	p.ConsecutiveFailures++
+
+	if p.Options.BreakerThreshold > 0 && p.ConsecutiveFailures >= int64(p.Options.BreakerThreshold) {
+		p.CircuitOpenUntil = time.Now().Add(p.Options.breakerCooldown())
+		log.Infof("Pool[%v]: opening circuit breaker for %v after %d failed scrapes", RedactAddress(p.Address), p.Options.breakerCooldown(), p.ConsecutiveFailures)
+	}
+}
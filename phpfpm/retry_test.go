@@ -0,0 +1,133 @@
+// Copyright © 2018 Enrico Stahn <enrico.stahn@gmail.com>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package phpfpm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	opts := PoolOptions{Backoff: 100 * time.Millisecond}
+
+	for retry, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: maxBackoff} {
+		for i := 0; i < 20; i++ {
+			delay := opts.retryDelay(retry)
+			assert.GreaterOrEqual(t, delay, max/2, retry)
+			assert.LessOrEqual(t, delay, max, retry)
+		}
+	}
+
+	assert.LessOrEqual(t, PoolOptions{}.retryDelay(1), DefaultBackoff)
+}
+
+func TestPoolUpdateRetriesTransientErrors(t *testing.T) {
+	var attempts atomic.Int64
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if r.URL.Path == "/fpm-status" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	p := Pool{Address: "tcp://" + address + "/status?retries=2&backoff=20ms"}
+	started := time.Now()
+	assert.Error(t, p.Update())
+	assert.Equal(t, int64(3), attempts.Load())
+	assert.GreaterOrEqual(t, time.Since(started), 30*time.Millisecond, "jittered backoff of at least 10ms and 20ms")
+
+	attempts.Store(0)
+	p = Pool{Address: "tcp://" + address + "/fpm-status?retries=2&backoff=20ms"}
+	assert.Equal(t, ReasonNotFound, ErrorReason(p.Update()))
+	assert.Equal(t, int64(1), attempts.Load(), "a wrong status path isn't retried")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	p = Pool{Address: "tcp://" + address + "/status?retries=5&backoff=1s"}
+	started = time.Now()
+	assert.Error(t, p.UpdateContext(ctx))
+	assert.Less(t, time.Since(started), 500*time.Millisecond, "backoff is aborted with the context")
+}
+
+func TestPoolUpdateCircuitBreaker(t *testing.T) {
+	var down atomic.Bool
+	var attempts atomic.Int64
+	address := listenFCGI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(statusJSON))
+	}))
+
+	p := Pool{Address: "tcp://" + address + "/status?breaker_threshold=2&breaker_cooldown=100ms"}
+	require.NoError(t, p.Update())
+
+	down.Store(true)
+	assert.Error(t, p.Update())
+	assert.False(t, p.CircuitOpen())
+	assert.Error(t, p.Update())
+	assert.True(t, p.CircuitOpen(), "opened after 2 failed scrapes")
+	assert.Equal(t, int64(3), attempts.Load())
+
+	err := p.Update()
+	assert.Equal(t, ReasonCircuitOpen, ErrorReason(err))
+	assert.Equal(t, int64(3), attempts.Load(), "PHP-FPM isn't scraped while the breaker is open")
+	assert.Equal(t, int64(2), p.ScrapeFailures, "skipped scrapes aren't failures")
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Error(t, p.Update())
+	assert.Equal(t, int64(4), attempts.Load(), "a single scrape is let through after the cooldown")
+	assert.True(t, p.CircuitOpen(), "opened again right away")
+
+	down.Store(false)
+	p.CircuitOpenUntil = time.Time{}
+	require.NoError(t, p.Update())
+	assert.False(t, p.CircuitOpen())
+	assert.Equal(t, int64(0), p.ConsecutiveFailures)
+}
+
+func TestExporterCircuitOpen(t *testing.T) {
+	address := closedAddress(t)
+
+	pm := PoolManager{}
+	pm.Add("tcp://" + address + "/status?breaker_threshold=1&breaker_cooldown=1m")
+	e := NewExporter(&pm)
+
+	expected := `
+# HELP phpfpm_pool_circuit_open Whether scrapes of the pool are skipped because its last scrapes failed.
+# TYPE phpfpm_pool_circuit_open gauge
+phpfpm_pool_circuit_open{pool="",scrape_uri="tcp://` + address + `/status?breaker_threshold=1&breaker_cooldown=1m"} 1
+# HELP phpfpm_scrape_errors_total The number of failures scraping from PHP-FPM by reason.
+# TYPE phpfpm_scrape_errors_total counter
+phpfpm_scrape_errors_total{pool="",reason="dial_refused",scrape_uri="tcp://` + address + `/status?breaker_threshold=1&breaker_cooldown=1m"} 1
+# HELP phpfpm_up Could PHP-FPM be reached?
+# TYPE phpfpm_up gauge
+phpfpm_up{pool="",scrape_uri="tcp://` + address + `/status?breaker_threshold=1&breaker_cooldown=1m"} 0
+`
+	_ = testutil.CollectAndCount(e)
+	require.NoError(t, testutil.CollectAndCompare(e, strings.NewReader(expected), "phpfpm_pool_circuit_open", "phpfpm_scrape_errors_total", "phpfpm_up"))
+}